@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SCOPE_STAT          = "stat:read"
+	SCOPE_PING          = "probe:ping"
+	SCOPE_MTR           = "probe:mtr"
+	SCOPE_MTR_UNMASKED  = "mtr:unmasked"
+	SCOPE_IPERF3        = "probe:iperf3"
+	SCOPE_IPERF3_SERVER = "iperf3:server"
+)
+
+type apiKey struct {
+	name   string
+	secret string
+	scopes []string
+	nets   []*net.IPNet
+	expire time.Time
+}
+
+var (
+	apiKeys  map[string]*apiKey
+	keyNames map[string]*apiKey
+	certKeys map[string]*apiKey
+	nonces   *nonceCache
+)
+
+// loadKeys builds the key table from Config. The legacy single Key gets
+// every scope; with no key configured at all the api stays open like it
+// always did.
+func loadKeys() error {
+	apiKeys = map[string]*apiKey{}
+	keyNames = map[string]*apiKey{}
+	certKeys = map[string]*apiKey{}
+	window := time.Duration(Config.Auth.Window) * time.Second
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	nonces = &nonceCache{window: window, seen: map[string]time.Time{}}
+	if Config.Key != "" || len(Config.Keys) == 0 && len(Config.Tls.Clients) == 0 {
+		k := &apiKey{name: "default", secret: Config.Key, scopes: []string{"*"}}
+		apiKeys[Config.Key] = k
+		keyNames[k.name] = k
+	}
+	for _, k := range Config.Keys {
+		if k.Key == "" {
+			return fmt.Errorf("key %q: empty key", k.Name)
+		}
+		if _, ok := apiKeys[k.Key]; ok {
+			return fmt.Errorf("key %q: duplicate key", k.Name)
+		}
+		if _, ok := keyNames[k.Name]; ok {
+			return fmt.Errorf("key %q: duplicate name", k.Name)
+		}
+		ak := &apiKey{name: k.Name, secret: k.Key, scopes: k.Scopes, expire: k.Expire}
+		for _, s := range k.Scopes {
+			if _, err := path.Match(s, ""); err != nil {
+				return fmt.Errorf("key %q: bad scope %q", k.Name, s)
+			}
+		}
+		for _, cidr := range k.Cidrs {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("key %q: %v", k.Name, err)
+			}
+			ak.nets = append(ak.nets, n)
+		}
+		apiKeys[k.Key] = ak
+		keyNames[k.Name] = ak
+	}
+	for _, cl := range Config.Tls.Clients {
+		for _, s := range cl.Scopes {
+			if _, err := path.Match(s, ""); err != nil {
+				return fmt.Errorf("client %q: bad scope %q", cl.Cn, s)
+			}
+		}
+		certKeys[cl.Cn] = &apiKey{name: "cert:" + cl.Cn, scopes: cl.Scopes}
+	}
+	return nil
+}
+
+// certKey returns the key of a verified client certificate, if any.
+func certKey(c *gin.Context) *apiKey {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return certKeys[state.VerifiedChains[0][0].Subject.CommonName]
+}
+
+func (k *apiKey) allowed(ip net.IP) bool {
+	if len(k.nets) == 0 {
+		return true
+	}
+	for _, n := range k.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *apiKey) can(scope string) bool {
+	for _, s := range k.scopes {
+		if ok, _ := path.Match(s, scope); ok || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// grants is can without the wildcard "*", for scopes that must be given
+// explicitly.
+func (k *apiKey) grants(scope string) bool {
+	for _, s := range k.scopes {
+		if ok, _ := path.Match(s, scope); ok && s != "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate finds the key of a request by client certificate, signature
+// or plain key in that order.
+func authenticate(c *gin.Context) (*apiKey, error) {
+	if k := certKey(c); k != nil {
+		return k, nil
+	}
+	sig, err := parseSignature(c.Request)
+	if err != nil {
+		return nil, err
+	}
+	if sig != nil {
+		k, ok := keyNames[sig.keyID]
+		if !ok || k.secret == "" || !sig.verify(c.Request, k.secret) {
+			return nil, errBadSign
+		}
+		if err := nonces.check(sig.keyID, sig.nonce, sig.timestamp); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	key := c.Request.Header.Get("key")
+	if key == "" {
+		key = c.Query("key")
+	}
+	k, ok := apiKeys[key]
+	if !ok || Config.Auth.DisablePlain && k.secret != "" {
+		return nil, errIncorrect
+	}
+	return k, nil
+}
+
+var errIncorrect = errors.New("Api key Incorrect")
+
+func checkKey(c *gin.Context) {
+	k, err := authenticate(c)
+	if err != nil {
+		resp(c, false, err.Error(), 401)
+		c.Abort()
+		return
+	}
+	if !k.expire.IsZero() && time.Now().After(k.expire) {
+		resp(c, false, "Api key expired", 401)
+		c.Abort()
+		return
+	}
+	if !k.allowed(net.ParseIP(c.ClientIP())) {
+		resp(c, false, "Source address not allowed", 403)
+		c.Abort()
+		return
+	}
+	c.Set("key", k)
+	c.Next()
+}
+
+// scope rejects requests whose key lacks the given scope.
+func scope(s string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.MustGet("key").(*apiKey).can(s) {
+			resp(c, false, "Api key lacks scope "+s, 403)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,8 +1,234 @@
 package main
 
+import "time"
+
+const (
+	MODE_API  = 0
+	MODE_PUSH = 1
+	MODE_BOTH = 2
+)
+
 type CONF struct {
 	Mode int
 	Key  string
 	Port int
 	Url  string
+	Push PUSH
+	Stat STAT
+	Keys []KEY
+	Auth AUTH
+	Tls  TLS
+
+	Probes     PROBES
+	Targets    TARGETS
+	Jobs       JOBS
+	Mtr        MTR
+	Iperf3     IPERF3
+	Throughput THROUGHPUT
+	RateLimits map[string]RATELIMIT `yaml:"ratelimit"`
+
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// ShutdownTimeout is how long, in seconds, running requests and probes
+	// get to finish after SIGINT or SIGTERM.
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+}
+
+// KEY is a named api key. Scopes may use path.Match patterns like
+// "probe:*", Cidrs restricts the source addresses and a zero Expire never
+// expires.
+type KEY struct {
+	Name   string
+	Key    string
+	Scopes []string
+	Cidrs  []string
+	Expire time.Time
+}
+
+// PUSH configures push mode, durations are in seconds.
+type PUSH struct {
+	Interval int
+	Jitter   int
+	Timeout  int
+	Spool    int
+}
+
+// STAT configures the stat sampler, Resolution is in milliseconds and
+// History is the number of snapshots kept.
+type STAT struct {
+	Resolution int
+	History    int
+	Disk       DISK
+}
+
+// DISK overrides the default disk filters of the stat package when set.
+type DISK struct {
+	Mountpoints   []string
+	IgnoreFstypes []string `yaml:"ignore_fstypes"`
+	IgnoreDevices []string `yaml:"ignore_devices"`
+}
+
+// AUTH configures request authentication. Signed requests are always
+// accepted, DisablePlain rejects the plain key in header or query. Window is
+// in seconds.
+type AUTH struct {
+	DisablePlain bool `yaml:"disable_plain"`
+	Window       int
+}
+
+// TLS enables https when Cert and Key are set. SelfSigned generates them if
+// missing. With ClientCa client certificates are verified and the common
+// names listed in Clients get their scopes without an api key.
+type TLS struct {
+	Cert              string
+	Key               string
+	SelfSigned        bool   `yaml:"self_signed"`
+	ClientCa          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+	Clients           []TLSCLIENT
+}
+
+type TLSCLIENT struct {
+	Cn     string
+	Scopes []string
+}
+
+// PROBES limits the concurrent probes of each type, up to Queue more
+// requests wait for a free slot. A Queue of -1 rejects busy requests at once.
+type PROBES struct {
+	Ping   LIMIT
+	Mtr    LIMIT
+	Iperf3 LIMIT
+}
+
+type LIMIT struct {
+	Concurrency int
+	Queue       int
+}
+
+// JOBS configures the background probes, finished jobs are kept for Ttl
+// seconds.
+type JOBS struct {
+	Ttl int
+}
+
+// MTR sets the defaults of mtr runs, which requests may override within
+// Limits. Interval and Timeout are in milliseconds, Size is the packet size
+// in bytes, Source a local address or interface and Family the preferred
+// address family, 4 or 6, hosts without addresses in it use the other one.
+// Flows is the number of flows of multipath runs.
+type MTR struct {
+	Count    int
+	Interval int
+	Timeout  int
+	MaxHops  int `yaml:"max_hops"`
+	Size     int
+	Source   string
+	RDNS     bool `yaml:"rdns"`
+	Family   int
+	Flows    int
+	Limits   MTRLIMITS
+	Mask     MTRMASK
+	Enrich   ENRICH
+}
+
+// MTRLIMITS bounds the options of mtr requests. MinInterval and MaxTimeout
+// are in milliseconds, MaxTime in seconds bounds a whole run. Requests may
+// only pick the source when AllowSource is set.
+type MTRLIMITS struct {
+	MaxCount    int  `yaml:"max_count"`
+	MinInterval int  `yaml:"min_interval"`
+	MaxTimeout  int  `yaml:"max_timeout"`
+	MaxHops     int  `yaml:"max_hops"`
+	MaxSize     int  `yaml:"max_size"`
+	MaxTime     int  `yaml:"max_time"`
+	MaxFlows    int  `yaml:"max_flows"`
+	AllowSource bool `yaml:"allow_source"`
+}
+
+// MTRMASK hides the hops near the exporter from keys without the
+// mtr:unmasked scope: the first Hops, 0 takes 5 and a negative value none,
+// and those inside the own networks listed in Prefixes or, given enrich
+// databases, originated by Asns wherever they are. Masked addresses keep
+// their first IPv4 or IPv6 bits, 24 and 48 by default.
+type MTRMASK struct {
+	Hops     int
+	Prefixes []string
+	Asns     []uint32
+	IPv4     int `yaml:"ipv4"`
+	IPv6     int `yaml:"ipv6"`
+}
+
+// ENRICH lists the offline databases mtr hops are described from, mmdb
+// files like GeoLite2-ASN and GeoLite2-Country or ip2asn dumps ending in
+// .tsv or .tsv.gz, earlier ones first. Cache is the number of addresses
+// remembered.
+type ENRICH struct {
+	Databases []string
+	Cache     int
+}
+
+// IPERF3 configures the iperf3 binary, looked up in PATH when Path is
+// empty, the client tests and the servers started through the api.
+type IPERF3 struct {
+	Path   string
+	Limits IPERF3LIMITS
+	Server IPERF3SERVER
+}
+
+// IPERF3LIMITS bounds the options of client tests. MaxTime and MaxOmit are
+// in seconds, MaxBitrate in bits per second (0 is unlimited) and MaxWindow
+// in bytes.
+type IPERF3LIMITS struct {
+	MaxTime     int    `yaml:"max_time"`
+	MaxParallel int    `yaml:"max_parallel"`
+	MaxBitrate  uint64 `yaml:"max_bitrate"`
+	MaxWindow   int    `yaml:"max_window"`
+	MaxOmit     int    `yaml:"max_omit"`
+}
+
+// IPERF3SERVER limits the managed iperf3 servers to Max at once, listening
+// on ports between MinPort and MaxPort. Idle is the idle timeout in seconds
+// of servers started without one, Results the number of test results kept
+// per server.
+type IPERF3SERVER struct {
+	Max     int
+	MinPort int `yaml:"min_port"`
+	MaxPort int `yaml:"max_port"`
+	Idle    int
+	Results int
+}
+
+// THROUGHPUT configures the native throughput test. The server listens on
+// Port, tcp and udp, when it is set, and then needs a Secret. Secret is
+// required from clients and sent to the servers of other exporters, MaxTime
+// is in seconds and MaxRate in bits per second.
+type THROUGHPUT struct {
+	Port       int
+	Secret     string
+	MaxTime    int    `yaml:"max_time"`
+	MaxStreams int    `yaml:"max_streams"`
+	MaxRate    uint64 `yaml:"max_rate"`
+}
+
+// TARGETS restricts the hosts probes may target, see policy.New. Reserved
+// addresses are denied unless AllowReserved is set or Allow lists them.
+type TARGETS struct {
+	Allow         []string
+	Deny          []string
+	AllowReserved bool `yaml:"allow_reserved"`
+}
+
+// RATELIMIT limits the requests to one endpoint per api key and per source
+// address. Jobs count against the endpoint of their type, like /mtr.
+type RATELIMIT struct {
+	Key BUCKET
+	Ip  BUCKET
+}
+
+// BUCKET is a token bucket refilling Rate tokens per minute up to Burst, a
+// zero Rate disables it.
+type BUCKET struct {
+	Rate  float64
+	Burst float64
 }
@@ -0,0 +1,102 @@
+// Package ipdb describes addresses from offline databases: the origin AS,
+// announced prefix and country from MaxMind style mmdb files and ip2asn
+// tsv dumps.
+package ipdb
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// Info is what the databases know about an address. Prefix is the
+// announced network holding it.
+type Info struct {
+	ASN     uint32 `json:",omitempty"`
+	ASName  string `json:",omitempty"`
+	Prefix  string `json:",omitempty"`
+	Country string `json:",omitempty"`
+}
+
+// merge fills the fields of i that are still empty from o.
+func (i *Info) merge(o Info) {
+	if i.ASN == 0 {
+		i.ASN, i.ASName, i.Prefix = o.ASN, o.ASName, o.Prefix
+	}
+	if i.Country == "" {
+		i.Country = o.Country
+	}
+}
+
+type source interface {
+	lookup(ip net.IP) Info
+	close() error
+}
+
+// DB looks addresses up in its sources in the order they were opened,
+// the first one knowing a field wins. Up to Cache answers are remembered.
+type DB struct {
+	Cache int
+
+	sources []source
+	mu      sync.Mutex
+	cache   map[string]Info
+}
+
+// Open opens the databases, files ending in .tsv or .tsv.gz are read as
+// ip2asn dumps and the others as mmdb.
+func Open(files ...string) (*DB, error) {
+	db := &DB{Cache: 4096, cache: map[string]Info{}}
+	for _, f := range files {
+		var s source
+		var err error
+		if strings.HasSuffix(f, ".tsv") || strings.HasSuffix(f, ".tsv.gz") {
+			s, err = openTSV(f)
+		} else {
+			s, err = openMMDB(f)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.sources = append(db.sources, s)
+	}
+	return db, nil
+}
+
+// Lookup describes ip.
+func (db *DB) Lookup(ip net.IP) Info {
+	key := ip.String()
+	db.mu.Lock()
+	info, ok := db.cache[key]
+	db.mu.Unlock()
+	if ok {
+		return info
+	}
+	for _, s := range db.sources {
+		info.merge(s.lookup(ip))
+	}
+	db.mu.Lock()
+	if len(db.cache) >= db.Cache {
+		// forget an arbitrary entry
+		for k := range db.cache {
+			delete(db.cache, k)
+			break
+		}
+	}
+	if db.Cache > 0 {
+		db.cache[key] = info
+	}
+	db.mu.Unlock()
+	return info
+}
+
+func (db *DB) Close() error {
+	var err error
+	for _, s := range db.sources {
+		if e := s.close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package ipdb
+
+import (
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTSV(t *testing.T) {
+	plain := filepath.Join("testdata", "ip2asn.tsv")
+	// the same dump gzipped
+	b, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := filepath.Join(t.TempDir(), "ip2asn.tsv.gz")
+	f, err := os.Create(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write(b)
+	w.Close()
+	f.Close()
+
+	for _, file := range []string{plain, gz} {
+		db, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, tc := range []struct {
+			ip   string
+			info Info
+		}{
+			{"1.0.0.7", Info{ASN: 13335, ASName: "CLOUDFLARENET", Prefix: "1.0.0.0/24", Country: "US"}},
+			{"1.0.2.1", Info{}},
+			{"1.0.4.9", Info{ASN: 38803, ASName: "GTELECOM-AUSTRALIA Gtelecom Pty Ltd", Prefix: "1.0.4.0/23", Country: "AU"}},
+			{"1.0.6.5", Info{ASN: 38803, ASName: "GTELECOM-AUSTRALIA Gtelecom Pty Ltd", Prefix: "1.0.6.0/24", Country: "AU"}},
+			{"0.0.0.1", Info{}},
+			{"8.8.8.8", Info{}},
+			{"2001:200:123::1", Info{ASN: 2500, ASName: "WIDE-BB WIDE Project", Prefix: "2001:200::/38", Country: "JP"}},
+			{"2001:200:5aa::1", Info{ASN: 2500, ASName: "WIDE-BB WIDE Project", Prefix: "2001:200:400::/39", Country: "JP"}},
+			{"2001:200:700::1", Info{ASN: 7667, ASName: "KDDLAB", Prefix: "2001:200:600::/39", Country: "JP"}},
+			{"2001:200:850::1", Info{}},
+			{"2c0f:fff0::1", Info{ASN: 37125, ASName: "LAYER3-NET", Prefix: "2c0f:fff0::/32"}},
+		} {
+			if info := db.Lookup(net.ParseIP(tc.ip)); info != tc.info {
+				t.Errorf("%s: %s: got %+v, want %+v", file, tc.ip, info, tc.info)
+			}
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	db, err := Open(filepath.Join("testdata", "ip2asn.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Cache = 2
+	for _, ip := range []string{"1.0.0.1", "1.0.0.2", "1.0.0.3"} {
+		db.Lookup(net.ParseIP(ip))
+	}
+	if len(db.cache) != 2 {
+		t.Fatalf("%d answers cached, want 2", len(db.cache))
+	}
+	// cached answers are used without the sources
+	sources := db.sources
+	db.sources = nil
+	if info := db.Lookup(net.ParseIP("1.0.0.3")); info.ASN != 13335 {
+		t.Fatalf("1.0.0.3 not cached: %+v", info)
+	}
+	db.sources = sources
+
+	db.Cache, db.cache = 0, map[string]Info{}
+	db.Lookup(net.ParseIP("1.0.0.1"))
+	if len(db.cache) != 0 {
+		t.Fatalf("%d answers cached without a cache", len(db.cache))
+	}
+}
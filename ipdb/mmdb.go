@@ -0,0 +1,47 @@
+package ipdb
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// record holds the fields of the GeoLite2 and DB-IP lite ASN, Country and
+// City databases.
+type record struct {
+	ASN     uint32 `maxminddb:"autonomous_system_number"`
+	ASName  string `maxminddb:"autonomous_system_organization"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type mmdb struct {
+	r *maxminddb.Reader
+}
+
+func openMMDB(file string) (*mmdb, error) {
+	r, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdb{r: r}, nil
+}
+
+func (m *mmdb) lookup(ip net.IP) (info Info) {
+	var rec record
+	network, ok, err := m.r.LookupNetwork(ip, &rec)
+	if err != nil || !ok {
+		return
+	}
+	info.Country = rec.Country.ISOCode
+	if rec.ASN != 0 {
+		// the networks of asn databases are the announced prefixes
+		info.ASN, info.ASName, info.Prefix = rec.ASN, rec.ASName, network.String()
+	}
+	return
+}
+
+func (m *mmdb) close() error {
+	return m.r.Close()
+}
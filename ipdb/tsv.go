@@ -0,0 +1,125 @@
+package ipdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asRange is a line of an ip2asn dump, the addresses in 16 byte form.
+type asRange struct {
+	start, end net.IP
+	asn        uint32
+	country    string
+	name       string
+}
+
+// tsv is an ip2asn dump like iptoasn.com's ip2asn-combined.tsv: range
+// start, range end, AS number, country and AS description, tab separated.
+type tsv struct {
+	ranges []asRange
+}
+
+func openTSV(file string) (*tsv, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	t := &tsv{}
+	names := map[string]string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid line", file, n)
+		}
+		if asn == 0 {
+			// not routed
+			continue
+		}
+		name, ok := names[fields[4]]
+		if !ok {
+			name = fields[4]
+			names[name] = name
+		}
+		country := fields[3]
+		if country == "None" {
+			country = ""
+		}
+		t.ranges = append(t.ranges, asRange{start: start.To16(), end: end.To16(), asn: uint32(asn), country: country, name: name})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(t.ranges, func(i, j int) bool {
+		return bytes.Compare(t.ranges[i].start, t.ranges[j].start) < 0
+	})
+	return t, nil
+}
+
+func (t *tsv) lookup(ip net.IP) (info Info) {
+	ip16 := ip.To16()
+	// the last range starting at or before ip
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return bytes.Compare(t.ranges[i].start, ip16) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip16, t.ranges[i].end) > 0 {
+		return
+	}
+	r := t.ranges[i]
+	info = Info{ASN: r.asn, ASName: r.name, Country: r.country}
+	if n := prefix(ip, r.start, r.end); n != nil {
+		info.Prefix = n.String()
+	}
+	return
+}
+
+// prefix returns the largest network holding ip within start and end, the
+// dumps list ranges rather than the announced prefixes.
+func prefix(ip, start, end net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, start, end = ip4, start.To4(), end.To4()
+		if start == nil || end == nil {
+			return nil
+		}
+	}
+	bits := len(ip) * 8
+	for ones := 0; ones <= bits; ones++ {
+		mask := net.CIDRMask(ones, bits)
+		lo := ip.Mask(mask)
+		hi := make(net.IP, len(lo))
+		for i := range lo {
+			hi[i] = lo[i] | ^mask[i]
+		}
+		if bytes.Compare(lo, start) >= 0 && bytes.Compare(hi, end) <= 0 {
+			return &net.IPNet{IP: lo, Mask: mask}
+		}
+	}
+	return nil
+}
+
+func (t *tsv) close() error {
+	return nil
+}
@@ -1,32 +1,274 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"neko-exporter/iperf3"
+	"neko-exporter/throughput"
+	"net"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Iperf3(c *gin.Context) {
-	host := c.PostForm("host")
-	port, _ := strconv.Atoi(c.PostForm("port"))
-	if port == 0 {
-		port = 5201
+const (
+	ENGINE_IPERF3 = "iperf3"
+	ENGINE_NATIVE = "native"
+)
+
+// iperf3Query is a throughput test, run by the iperf3 binary or the native
+// engine against another exporter, which takes only the basic options and
+// the bitrate.
+type iperf3Query struct {
+	engine string
+	iperf3.Options
+}
+
+// congestionName matches a linux congestion control algorithm name.
+var congestionName = regexp.MustCompile(`^[a-z0-9_-]{1,15}$`)
+
+// parseRate parses a count with an optional k, m or g suffix of unit.
+func parseRate(s string, unit uint64) (uint64, error) {
+	mul := uint64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mul = unit
+	case "m":
+		mul = unit * unit
+	case "g":
+		mul = unit * unit * unit
+	}
+	if mul > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/mul {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n * mul, nil
+}
+
+// checkBind validates an address to bind to, with an optional %interface.
+func checkBind(bind string) error {
+	host, dev, scoped := strings.Cut(bind, "%")
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid bind address %q", host)
+	}
+	if scoped {
+		if _, err := net.InterfaceByName(dev); err != nil {
+			return fmt.Errorf("unknown interface %q", dev)
+		}
+	}
+	return nil
+}
+
+// checkCongestion validates a congestion control algorithm against those
+// the kernel offers, when it tells.
+func checkCongestion(name string) error {
+	if !congestionName.MatchString(name) {
+		return fmt.Errorf("invalid congestion control %q", name)
+	}
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return nil
+	}
+	for _, f := range strings.Fields(string(b)) {
+		if f == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("congestion control %q is not available", name)
+}
+
+func parseIperf3(get func(string) string, defaultTime int) (iperf3Query, error) {
+	limits := Config.Iperf3.Limits
+	flag := func(name string) bool {
+		return get(name) != "" && get(name) != "false"
+	}
+	q := iperf3Query{engine: get("engine")}
+	q.Host = get("host")
+	q.Reverse = flag("reverse")
+	q.Bidir = flag("bidir")
+	q.Protocol = get("protocol")
+	q.Bind = get("bind")
+	q.Congestion = get("congestion")
+	q.ZeroCopy = flag("zerocopy")
+	if q.engine == "" {
+		q.engine = ENGINE_IPERF3
+	}
+	if q.engine != ENGINE_IPERF3 && q.engine != ENGINE_NATIVE {
+		return q, fmt.Errorf("unknown engine %q", q.engine)
+	}
+	q.Port, _ = strconv.Atoi(get("port"))
+	if q.Port == 0 {
+		q.Port = 5201
+		if q.engine == ENGINE_NATIVE {
+			q.Port = throughput.DefaultPort
+		}
 	}
-	reverse := c.PostForm("reverse") == "true"
-	time, _ := strconv.Atoi(c.PostForm("time"))
-	if time == 0 {
-		time = 5
+	if q.Port < 1 || q.Port > 65535 {
+		return q, fmt.Errorf("invalid port %d", q.Port)
 	}
-	parallel, _ := strconv.Atoi(c.PostForm("parallel"))
-	if parallel == 0 {
-		parallel = 1
+	q.Time, _ = strconv.Atoi(get("time"))
+	if q.Time == 0 {
+		q.Time = defaultTime
 	}
-	protocol := c.PostForm("protocol")
-	if protocol == "" {
-		protocol = "tcp"
+	if q.Time < 1 || q.Time > limits.MaxTime {
+		return q, fmt.Errorf("time must be between 1 and %d", limits.MaxTime)
+	}
+	q.Parallel, _ = strconv.Atoi(get("parallel"))
+	if q.Parallel == 0 {
+		q.Parallel = 1
+	}
+	if q.Parallel < 1 || q.Parallel > limits.MaxParallel {
+		return q, fmt.Errorf("parallel must be between 1 and %d", limits.MaxParallel)
+	}
+	if q.Protocol == "" {
+		q.Protocol = "tcp"
+	}
+	if q.Protocol != "tcp" && q.Protocol != "udp" {
+		return q, fmt.Errorf("unknown protocol %q", q.Protocol)
+	}
+	if q.Reverse && q.Bidir {
+		return q, errors.New("reverse and bidir exclude each other")
+	}
+	var err error
+	if r := get("bitrate"); r != "" {
+		if q.Bitrate, err = parseRate(r, 1000); err != nil {
+			return q, err
+		}
+	}
+	if limits.MaxBitrate > 0 && q.Bitrate > limits.MaxBitrate {
+		return q, fmt.Errorf("bitrate must be at most %d", limits.MaxBitrate)
+	}
+	if w := get("window"); w != "" {
+		window, err := parseRate(w, 1024)
+		if err != nil {
+			return q, err
+		}
+		if window < 1024 || window > uint64(limits.MaxWindow) {
+			return q, fmt.Errorf("window must be between 1024 and %d", limits.MaxWindow)
+		}
+		q.Window = int(window)
+	}
+	q.MSS, _ = strconv.Atoi(get("mss"))
+	if q.MSS != 0 && (q.MSS < 88 || q.MSS > 9216) {
+		return q, errors.New("mss must be between 88 and 9216")
+	}
+	q.Omit, _ = strconv.Atoi(get("omit"))
+	if q.Omit < 0 || q.Omit > limits.MaxOmit {
+		return q, fmt.Errorf("omit must be between 0 and %d", limits.MaxOmit)
+	}
+	switch f := get("family"); f {
+	case "":
+	case "4", "6":
+		q.Family, _ = strconv.Atoi(f)
+	default:
+		return q, fmt.Errorf("invalid family %q", f)
+	}
+	if q.Bind != "" {
+		if err := checkBind(q.Bind); err != nil {
+			return q, err
+		}
+	}
+	if q.Congestion != "" {
+		if err := checkCongestion(q.Congestion); err != nil {
+			return q, err
+		}
+	}
+	if q.Protocol == "udp" && (q.MSS > 0 || q.Congestion != "") {
+		return q, errors.New("mss and congestion apply to tcp only")
+	}
+	if q.engine == ENGINE_NATIVE && (q.Bidir || q.Window > 0 || q.MSS > 0 || q.Omit > 0 || q.Bind != "" || q.Congestion != "" || q.ZeroCopy) {
+		return q, errors.New("the native engine takes no bidir, window, mss, omit, bind, congestion or zerocopy")
+	}
+	return q, nil
+}
+
+// network is the address family to resolve the host in.
+func (q iperf3Query) network() string {
+	switch q.Family {
+	case 4:
+		return "ip4"
+	case 6:
+		return "ip6"
+	}
+	return "ip"
+}
+
+// run runs the test with q's engine.
+func (q iperf3Query) run(ctx context.Context, ws iperf3.Conn) (iperf3.Result, error) {
+	if q.engine == ENGINE_NATIVE {
+		return throughput.Client(ctx, throughput.Options{
+			Host:     q.Host,
+			Port:     q.Port,
+			Protocol: q.Protocol,
+			Streams:  q.Parallel,
+			Time:     q.Time,
+			Reverse:  q.Reverse,
+			Rate:     q.Bitrate,
+			Secret:   Config.Throughput.Secret,
+		}, ws)
+	}
+	return iperf3.Client(ctx, q.Options, ws)
+}
+
+// serveThroughput runs the native throughput server if configured.
+func serveThroughput() error {
+	conf := Config.Throughput
+	if conf.Port == 0 {
+		return nil
 	}
-	res, err := iperf3.Client(host, port, reverse, time, parallel, protocol, nil)
+	if conf.Secret == "" {
+		return errors.New("throughput: a secret is required to serve tests")
+	}
+	if conf.MaxTime == 0 {
+		conf.MaxTime = 60
+	}
+	if conf.MaxStreams == 0 {
+		conf.MaxStreams = 16
+	}
+	if conf.MaxRate == 0 {
+		conf.MaxRate = 100 * 1000 * 1000
+	}
+	s := &throughput.Server{
+		Port:       conf.Port,
+		Secret:     conf.Secret,
+		MaxTime:    conf.MaxTime,
+		MaxStreams: conf.MaxStreams,
+		MaxRate:    conf.MaxRate,
+	}
+	fmt.Println("Throughput port:", conf.Port)
+	go func() {
+		if err := s.Serve(baseCtx); err != nil {
+			log.Println("throughput server:", err)
+		}
+	}()
+	return nil
+}
+
+func Iperf3(c *gin.Context) {
+	q, err := parseIperf3(c.PostForm, 5)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
+	}
+	if q.Host = resolveTarget(c, q.network(), q.Host); q.Host == "" {
+		return
+	}
+	release := acquire(c, "iperf3")
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := q.run(c.Request.Context(), nil)
 	if err == nil {
 		resp(c, true, res, 200)
 	} else {
@@ -35,43 +277,111 @@ func Iperf3(c *gin.Context) {
 }
 
 func Iperf3Ws(c *gin.Context) {
-	host := c.Query("host")
-	port, _ := strconv.Atoi(c.Query("port"))
-	if port == 0 {
-		port = 5201
-	}
-	reverse := c.Query("reverse") != ""
-	time, _ := strconv.Atoi(c.Query("time"))
-	if time == 0 {
-		time = 10
-	}
-	parallel, _ := strconv.Atoi(c.Query("parallel"))
-	if parallel == 0 {
-		parallel = 1
+	q, err := parseIperf3(c.Query, 10)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
 	}
-	protocol := c.Query("protocol")
-	if protocol == "" {
-		protocol = "tcp"
+	if q.Host = resolveTarget(c, q.network(), q.Host); q.Host == "" {
+		return
 	}
-	ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	ws, err := upgrade(c)
 	if err != nil {
 		return
 	}
-	iperf3.Client(host, port, reverse, time, parallel, protocol, ws)
+	defer ws.release()
+	ctx, cancel := wsContext(ws)
+	defer cancel()
+	release := acquireWs(ctx, ws, "iperf3")
+	if release == nil {
+		return
+	}
+	defer release()
+	q.run(ctx, ws)
 }
 
-func Iperf3Serve(c *gin.Context) {
-	port, _ := strconv.Atoi(c.Query("port"))
-	if err := iperf3.Serve(port); err == nil {
-		resp(c, true, nil, 200)
-	} else {
+// loadIperf3 applies the iperf3 binary and the limits of the tests and
+// servers.
+func loadIperf3() {
+	iperf3.Path = Config.Iperf3.Path
+	limits := &Config.Iperf3.Limits
+	if limits.MaxTime == 0 {
+		limits.MaxTime = 60
+	}
+	if limits.MaxParallel == 0 {
+		limits.MaxParallel = 16
+	}
+	if limits.MaxWindow == 0 {
+		limits.MaxWindow = 16 * 1024 * 1024
+	}
+	if limits.MaxOmit == 0 {
+		limits.MaxOmit = 10
+	}
+	conf := &Config.Iperf3.Server
+	if conf.Max > 0 {
+		iperf3.DefaultServers.Max = conf.Max
+	}
+	if conf.Results > 0 {
+		iperf3.DefaultServers.Results = conf.Results
+	}
+	if conf.MinPort == 0 {
+		conf.MinPort = 5201
+	}
+	if conf.MaxPort == 0 {
+		conf.MaxPort = 5299
+	}
+	if conf.Idle == 0 {
+		conf.Idle = 3600
+	}
+}
+
+func Iperf3ServerStatus(c *gin.Context) {
+	resp(c, true, iperf3.DefaultServers.Status(), 200)
+}
+
+func Iperf3ServerStart(c *gin.Context) {
+	conf := Config.Iperf3.Server
+	opt := iperf3.ServerOptions{
+		Once: c.PostForm("once") != "" && c.PostForm("once") != "false",
+	}
+	opt.Port, _ = strconv.Atoi(c.PostForm("port"))
+	if opt.Port == 0 {
+		opt.Port = conf.MinPort
+	}
+	if opt.Port < conf.MinPort || opt.Port > conf.MaxPort {
+		resp(c, false, fmt.Sprintf("port must be between %d and %d", conf.MinPort, conf.MaxPort), 400)
+		return
+	}
+	idle, _ := strconv.Atoi(c.PostForm("idle"))
+	if idle <= 0 {
+		idle = conf.Idle
+	}
+	opt.Idle = time.Duration(idle) * time.Second
+	status, err := iperf3.DefaultServers.Start(opt)
+	switch err {
+	case nil:
+		resp(c, true, status, 200)
+	case iperf3.ErrServerRunning:
+		resp(c, false, gin.H{"error": err.Error(), "server": status}, 409)
+	case iperf3.ErrTooManyServers:
+		resp(c, false, err.Error(), 503)
+	default:
 		resp(c, false, err.Error(), 500)
 	}
 }
-func Iperf3Shutdown(c *gin.Context) {
-	if err := iperf3.Shutdown(); err == nil {
+
+func Iperf3ServerStop(c *gin.Context) {
+	port, err := strconv.Atoi(c.Param("port"))
+	if err != nil {
+		resp(c, false, "invalid port", 400)
+		return
+	}
+	switch err := iperf3.DefaultServers.Stop(port); err {
+	case nil:
 		resp(c, true, nil, 200)
-	} else {
+	case iperf3.ErrNoServer:
+		resp(c, false, err.Error(), 404)
+	default:
 		resp(c, false, err.Error(), 500)
 	}
 }
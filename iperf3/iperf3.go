@@ -1,14 +1,20 @@
 package iperf3
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os/exec"
 	"strconv"
 	"strings"
-
-	"github.com/gorilla/websocket"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Stat is an interval or the total. Bitrate is in Mbits/sec and Transfer in
+// bytes, Sum has the complete numbers and Streams those of every stream.
 type Stat struct {
 	Type     string
 	Interval string
@@ -17,137 +23,162 @@ type Stat struct {
 	Retr     uint64 `json:",omitempty"`
 
 	Peak float64 `json:",omitempty"`
+
+	Sum     *Stream  `json:",omitempty"`
+	Streams []Stream `json:",omitempty"`
+	// Reverse sums the opposite direction of a bidirectional test.
+	Reverse *Stream `json:",omitempty"`
 }
 
+// Result is a finished test. Sent and Received are the sums of both ends,
+// SentReverse and ReceivedReverse those of the opposite direction of a
+// bidirectional test. The congestion control algorithms are reported for
+// tcp only.
 type Result struct {
 	Success bool
 	Stats   []Stat `json:",omitempty"`
 	Total   Stat   `json:",omitempty"`
 	Err     string `json:",omitempty"`
+
+	Start              *Start  `json:",omitempty"`
+	Sent               *Stream `json:",omitempty"`
+	Received           *Stream `json:",omitempty"`
+	SentReverse        *Stream `json:",omitempty"`
+	ReceivedReverse    *Stream `json:",omitempty"`
+	CPU                *CPU    `json:",omitempty"`
+	SenderCongestion   string  `json:",omitempty"`
+	ReceiverCongestion string  `json:",omitempty"`
 }
 
-const iperf3path = "/usr/bin/iperf3"
+// Conn receives the streamed results, usually a *websocket.Conn.
+type Conn interface {
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// Path is the iperf3 binary, looked up in PATH when empty. Set it before
+// running the first test.
+var Path string
+
 const timeout = 5000
 
-func toStat(str string) Stat {
-	t := strings.Fields(str[5:])
-	// log.Println(str, t)
-	Transfer, _ := strconv.ParseFloat(t[2], 10)
-	var transfer uint64
-	switch t[3] {
-	case "TBytes":
-		transfer = uint64(Transfer) * 1024 * 1024 * 1024 * 1024
-	case "GBytes":
-		transfer = uint64(Transfer) * 1024 * 1024 * 1024
-	case "MBytes":
-		transfer = uint64(Transfer) * 1024 * 1024
-	case "KBytes":
-		transfer = uint64(Transfer) * 1024
-	}
-	bitrate, _ := strconv.ParseFloat(t[4], 10)
-	stat := Stat{
-		Interval: t[0],
-		Transfer: transfer,
-		Bitrate:  bitrate,
-	}
-	if len(t) > 7 {
-		retr, _ := strconv.Atoi(t[6])
-		stat.Retr = uint64(retr)
-	}
-	// log.Println(str,stat)
-	return stat
+// killWait is how long a cancelled iperf3 gets to exit after SIGTERM.
+const killWait = 2 * time.Second
+
+var jsonStream struct {
+	once sync.Once
+	ok   bool
+}
+
+// binary returns Path or the iperf3 found in PATH.
+func binary() string {
+	if Path != "" {
+		return Path
+	}
+	if p, err := exec.LookPath("iperf3"); err == nil {
+		return p
+	}
+	return "iperf3"
 }
 
-func analyze(stdout io.Reader, multi bool, ws *websocket.Conn) (res Result) {
-	waitID := true
-	buf := make([]byte, 2048)
-	for {
-		n, err := stdout.Read(buf)
+// hasJSONStream reports whether the installed iperf3 knows --json-stream,
+// added in 3.17.
+func hasJSONStream() bool {
+	jsonStream.once.Do(func() {
+		out, err := exec.Command(binary(), "--version").Output()
 		if err != nil {
-			break
+			return
 		}
-		str := string(buf[:n])
-		total := false
-		for _, L := range strings.Split(str, "\n") {
-			l := strings.TrimSpace(L)
-			if l == "" {
-				continue
-			}
-			if strings.HasPrefix(l, "iperf3: error - ") {
-				res.Success = false
-				res.Err = l[16:]
-				if ws != nil {
-					ws.WriteJSON(res)
-					ws.Close()
-				}
-				return
-			}
-			if waitID {
-				if strings.HasPrefix(l, "[ ID]") {
-					waitID = false
-				}
-				continue
-			}
-			if strings.HasPrefix(l, "- -") {
-				total = true
-				waitID = true
-				continue
-			}
-			if l[0] != '[' || (multi && l[1] != 'S') {
-				continue
-			}
-			if strings.HasSuffix(l, "Mbits/sec") || strings.HasSuffix(l, "Bytes") {
-				stat := toStat(l)
-				stat.Type = "interval"
-				res.Stats = append(res.Stats, stat)
-				if ws != nil {
-					ws.WriteJSON(stat)
-				}
-			}
-			if total && strings.HasSuffix(l, "sender") {
-				stat := toStat(l)
-				stat.Type = "total"
-				res.Total = stat
-			}
+		var major, minor int
+		if _, err := fmt.Sscanf(string(out), "iperf %d.%d", &major, &minor); err != nil {
+			return
 		}
-	}
-	res.Success = true
-	for _, stat := range res.Stats {
-		if stat.Bitrate > res.Total.Peak {
-			res.Total.Peak = stat.Bitrate
-		}
-	}
-	if ws != nil {
-		ws.WriteJSON(res)
-		ws.Close()
-	}
-	// log.Println(res)
-	return
+		jsonStream.ok = major > 3 || major == 3 && minor >= 17
+	})
+	return jsonStream.ok
+}
+
+// Options of a client test. Bitrate is the target in bits per second, 0
+// keeps iperf3's default, Window the socket buffer and MSS the tcp maximum
+// segment size in bytes. Omit skips the first seconds, Bind is a local
+// address with an optional %interface and Family 4 or 6 forces one.
+type Options struct {
+	Host       string
+	Port       int
+	Reverse    bool
+	Bidir      bool
+	Time       int
+	Parallel   int
+	Protocol   string
+	Bitrate    uint64
+	Window     int
+	MSS        int
+	Omit       int
+	Bind       string
+	Family     int
+	Congestion string
+	ZeroCopy   bool
 }
 
-func Client(host string, port int, reverse bool, ti int, parallel int, protocol string, ws *websocket.Conn) (res Result, err error) {
+func (opt Options) args() []string {
 	Args := []string{
-		iperf3path,
-		"-c", host,
-		"-p", strconv.Itoa(port),
-		"-P", strconv.Itoa(parallel),
-		"-t", strconv.Itoa(ti),
-		"--forceflush",
+		"-c", opt.Host,
+		"-p", strconv.Itoa(opt.Port),
+		"-P", strconv.Itoa(opt.Parallel),
+		"-t", strconv.Itoa(opt.Time),
 		"--connect-timeout", strconv.Itoa(timeout),
-		"-f", "mbps",
 	}
-	if reverse {
+	if hasJSONStream() {
+		Args = append(Args, "--json-stream", "--forceflush")
+	} else {
+		Args = append(Args, "-J")
+	}
+	if opt.Reverse {
 		// Args = append(Args, "--rcv-timeout", strconv.Itoa(timeout)) // unrecognized option '--rcv-timeout'
 		Args = append(Args, "-R")
 	}
-	if protocol == "udp" {
+	if opt.Bidir {
+		Args = append(Args, "--bidir")
+	}
+	if opt.Protocol == "udp" {
 		Args = append(Args, "-u")
 	}
-	// log.Println(Args)
-	cmd := exec.Cmd{
-		Path: iperf3path,
-		Args: Args,
+	if opt.Bitrate > 0 {
+		Args = append(Args, "-b", strconv.FormatUint(opt.Bitrate, 10))
+	}
+	if opt.Window > 0 {
+		Args = append(Args, "-w", strconv.Itoa(opt.Window))
+	}
+	if opt.MSS > 0 {
+		Args = append(Args, "-M", strconv.Itoa(opt.MSS))
+	}
+	if opt.Omit > 0 {
+		Args = append(Args, "-O", strconv.Itoa(opt.Omit))
+	}
+	if opt.Bind != "" {
+		Args = append(Args, "-B", opt.Bind)
+	}
+	switch opt.Family {
+	case 4:
+		Args = append(Args, "-4")
+	case 6:
+		Args = append(Args, "-6")
 	}
+	if opt.Congestion != "" {
+		Args = append(Args, "-C", opt.Congestion)
+	}
+	if opt.ZeroCopy {
+		Args = append(Args, "-Z")
+	}
+	return Args
+}
+
+// Client runs a test against an iperf3 server, streaming the intervals to
+// ws and closing it with the result.
+func Client(ctx context.Context, opt Options, ws Conn) (res Result, err error) {
+	Args := opt.args()
+	// log.Println(Args)
+	cmd := exec.Command(binary(), Args...)
 	stdout, er := cmd.StdoutPipe()
 	if er != nil {
 		err = er
@@ -159,7 +190,8 @@ func Client(host string, port int, reverse bool, ti int, parallel int, protocol
 		}
 		return
 	}
-	cmd.Stderr = cmd.Stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	if err = cmd.Start(); err != nil {
 		res.Success = false
 		res.Err = err.Error()
@@ -169,42 +201,40 @@ func Client(host string, port int, reverse bool, ti int, parallel int, protocol
 		}
 		return
 	}
-	res = analyze(stdout, parallel > 1, ws)
-	cmd.Wait()
-	return
-}
-
-var Iperf3Server *exec.Cmd
-
-func Serve(port int) error {
-	if port == 0 {
-		port = 5201
-	}
-	if Iperf3Server == nil {
-		Iperf3Server = &exec.Cmd{
-			Path: iperf3path,
-			Args: []string{
-				iperf3path,
-				"-s",
-				"-p", strconv.Itoa(port),
-			},
-		}
-		if err := Iperf3Server.Start(); err != nil {
-			Iperf3Server = nil
-			return err
+	exited := make(chan struct{})
+	go terminate(ctx, cmd, exited)
+	res = analyze(ctx, stdout, ws)
+	// keep iperf3 from blocking on a full pipe after a decoding error
+	io.Copy(io.Discard, stdout)
+	werr := cmd.Wait()
+	close(exited)
+	if !res.Success && res.Err == "" {
+		if res.Err = strings.TrimSpace(stderr.String()); res.Err == "" && werr != nil {
+			res.Err = werr.Error()
 		}
 	}
-	return nil
+	if ws != nil {
+		ws.WriteJSON(res)
+		ws.Close()
+	}
+	return
 }
 
-func Shutdown() error {
-	if Iperf3Server == nil {
-		return nil
+// terminate stops cmd once ctx is done, with SIGTERM first so iperf3 can
+// tell the server the test is over, and SIGKILL if it is still running after
+// killWait. exited is closed by the caller after cmd.Wait returned.
+func terminate(ctx context.Context, cmd *exec.Cmd, exited chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-ctx.Done():
 	}
-	if err := Iperf3Server.Process.Kill(); err != nil {
-		return err
+	cmd.Process.Signal(syscall.SIGTERM)
+	t := time.NewTimer(killWait)
+	defer t.Stop()
+	select {
+	case <-exited:
+	case <-t.C:
+		cmd.Process.Kill()
 	}
-	Iperf3Server.Wait()
-	Iperf3Server = nil
-	return nil
 }
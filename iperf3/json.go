@@ -0,0 +1,338 @@
+package iperf3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Stream holds the numbers of one stream, or the sum of all, over an
+// interval or the whole test. TCP senders report retransmits, the window
+// and the RTT (in microseconds), UDP receivers jitter and losses.
+type Stream struct {
+	Socket        int `json:",omitempty"`
+	Start         float64
+	End           float64
+	Seconds       float64
+	Bytes         uint64
+	BitsPerSecond float64
+	Retransmits   int     `json:",omitempty"`
+	SndCwnd       uint64  `json:",omitempty"`
+	SndWnd        uint64  `json:",omitempty"`
+	Rtt           uint64  `json:",omitempty"`
+	Rttvar        uint64  `json:",omitempty"`
+	MinRtt        uint64  `json:",omitempty"`
+	MaxRtt        uint64  `json:",omitempty"`
+	MeanRtt       uint64  `json:",omitempty"`
+	Pmtu          int     `json:",omitempty"`
+	Packets       int     `json:",omitempty"`
+	LostPackets   int     `json:",omitempty"`
+	LostPercent   float64 `json:",omitempty"`
+	OutOfOrder    int     `json:",omitempty"`
+	JitterMs      float64 `json:",omitempty"`
+	Omitted       bool    `json:",omitempty"`
+	Sender        bool
+}
+
+// CPU is the cpu utilisation in percent of both ends.
+type CPU struct {
+	HostTotal    float64
+	HostUser     float64
+	HostSystem   float64
+	RemoteTotal  float64
+	RemoteUser   float64
+	RemoteSystem float64
+}
+
+type Connection struct {
+	Socket     int
+	LocalHost  string
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+}
+
+// Start describes the test as iperf3 set it up.
+type Start struct {
+	Version    string
+	SystemInfo string
+	Connected  []Connection
+	TCPMSS     int `json:",omitempty"`
+	Protocol   string
+	NumStreams int
+	Blksize    int
+	Omit       int
+	Duration   int
+	Reverse    bool
+	Bidir      bool `json:",omitempty"`
+}
+
+// stream is Stream as iperf3 writes it.
+type stream struct {
+	Socket        int     `json:"socket"`
+	Start         float64 `json:"start"`
+	End           float64 `json:"end"`
+	Seconds       float64 `json:"seconds"`
+	Bytes         uint64  `json:"bytes"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+	Retransmits   int     `json:"retransmits"`
+	SndCwnd       uint64  `json:"snd_cwnd"`
+	SndWnd        uint64  `json:"snd_wnd"`
+	Rtt           uint64  `json:"rtt"`
+	Rttvar        uint64  `json:"rttvar"`
+	MinRtt        uint64  `json:"min_rtt"`
+	MaxRtt        uint64  `json:"max_rtt"`
+	MeanRtt       uint64  `json:"mean_rtt"`
+	Pmtu          int     `json:"pmtu"`
+	Packets       int     `json:"packets"`
+	LostPackets   int     `json:"lost_packets"`
+	LostPercent   float64 `json:"lost_percent"`
+	OutOfOrder    int     `json:"out_of_order"`
+	JitterMs      float64 `json:"jitter_ms"`
+	Omitted       bool    `json:"omitted"`
+	Sender        bool    `json:"sender"`
+}
+
+type cpu struct {
+	HostTotal    float64 `json:"host_total"`
+	HostUser     float64 `json:"host_user"`
+	HostSystem   float64 `json:"host_system"`
+	RemoteTotal  float64 `json:"remote_total"`
+	RemoteUser   float64 `json:"remote_user"`
+	RemoteSystem float64 `json:"remote_system"`
+}
+
+type start struct {
+	Version    string `json:"version"`
+	SystemInfo string `json:"system_info"`
+	Connected  []struct {
+		Socket     int    `json:"socket"`
+		LocalHost  string `json:"local_host"`
+		LocalPort  int    `json:"local_port"`
+		RemoteHost string `json:"remote_host"`
+		RemotePort int    `json:"remote_port"`
+	} `json:"connected"`
+	TCPMSS    int `json:"tcp_mss_default"`
+	TestStart struct {
+		Protocol   string `json:"protocol"`
+		NumStreams int    `json:"num_streams"`
+		Blksize    int    `json:"blksize"`
+		Omit       int    `json:"omit"`
+		Duration   int    `json:"duration"`
+		Reverse    int    `json:"reverse"`
+		Bidir      int    `json:"bidir"`
+	} `json:"test_start"`
+}
+
+type interval struct {
+	Streams []stream `json:"streams"`
+	Sum     *stream  `json:"sum"`
+	// SumBidirReverse is the opposite direction of a bidirectional test
+	SumBidirReverse *stream `json:"sum_bidir_reverse"`
+}
+
+type end struct {
+	Streams []struct {
+		Sender   *stream `json:"sender"`
+		Receiver *stream `json:"receiver"`
+		UDP      *stream `json:"udp"`
+	} `json:"streams"`
+	Sum                   *stream `json:"sum"`
+	SumSent               *stream `json:"sum_sent"`
+	SumReceived           *stream `json:"sum_received"`
+	SumSentReverse        *stream `json:"sum_sent_bidir_reverse"`
+	SumReceivedReverse    *stream `json:"sum_received_bidir_reverse"`
+	CPU                   *cpu    `json:"cpu_utilization_percent"`
+	SenderTCPCongestion   string  `json:"sender_tcp_congestion"`
+	ReceiverTCPCongestion string  `json:"receiver_tcp_congestion"`
+}
+
+// output is a line of --json-stream, an event with its data, or the single
+// document -J writes at exit.
+type output struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+
+	Start     *start     `json:"start"`
+	Intervals []interval `json:"intervals"`
+	End       *end       `json:"end"`
+	Error     string     `json:"error"`
+}
+
+func toStat(typ string, s *stream) Stat {
+	sum := Stream(*s)
+	return Stat{
+		Type:     typ,
+		Interval: fmt.Sprintf("%.2f-%.2f", s.Start, s.End),
+		Transfer: s.Bytes,
+		Bitrate:  s.BitsPerSecond / 1e6,
+		Retr:     uint64(s.Retransmits),
+		Sum:      &sum,
+	}
+}
+
+// start records the test set up, iperf3 reports a partial one when it
+// could not connect.
+func (res *Result) start(s *start) {
+	if len(s.Connected) == 0 {
+		return
+	}
+	res.Start = &Start{
+		Version:    s.Version,
+		SystemInfo: s.SystemInfo,
+		TCPMSS:     s.TCPMSS,
+		Protocol:   s.TestStart.Protocol,
+		NumStreams: s.TestStart.NumStreams,
+		Blksize:    s.TestStart.Blksize,
+		Omit:       s.TestStart.Omit,
+		Duration:   s.TestStart.Duration,
+		Reverse:    s.TestStart.Reverse != 0,
+		Bidir:      s.TestStart.Bidir != 0,
+	}
+	for _, c := range s.Connected {
+		res.Start.Connected = append(res.Start.Connected, Connection(c))
+	}
+}
+
+func (res *Result) interval(i interval, ws Conn) {
+	if i.Sum == nil {
+		return
+	}
+	stat := toStat("interval", i.Sum)
+	for _, s := range i.Streams {
+		stat.Streams = append(stat.Streams, Stream(s))
+	}
+	if i.SumBidirReverse != nil {
+		reverse := Stream(*i.SumBidirReverse)
+		stat.Reverse = &reverse
+	}
+	res.Stats = append(res.Stats, stat)
+	if ws != nil {
+		ws.WriteJSON(stat)
+	}
+}
+
+// end fills in the totals, a test without them did not complete.
+func (res *Result) end(e *end) {
+	sum := e.SumSent
+	if e.Sum != nil {
+		// udp, with jitter and losses
+		sum = e.Sum
+	}
+	if sum == nil {
+		return
+	}
+	res.Success = true
+	res.Total = toStat("total", sum)
+	for _, s := range e.Streams {
+		if s.Sender != nil {
+			s.Sender.Sender = true
+			res.Total.Streams = append(res.Total.Streams, Stream(*s.Sender))
+		}
+		if s.Receiver != nil {
+			s.Receiver.Sender = false
+			res.Total.Streams = append(res.Total.Streams, Stream(*s.Receiver))
+		}
+		if s.UDP != nil {
+			res.Total.Streams = append(res.Total.Streams, Stream(*s.UDP))
+		}
+	}
+	if e.SumSent != nil {
+		sent := Stream(*e.SumSent)
+		res.Sent = &sent
+	}
+	if e.SumReceived != nil {
+		received := Stream(*e.SumReceived)
+		res.Received = &received
+	}
+	if e.SumSentReverse != nil {
+		sent := Stream(*e.SumSentReverse)
+		res.SentReverse = &sent
+		res.Total.Reverse = &sent
+	}
+	if e.SumReceivedReverse != nil {
+		received := Stream(*e.SumReceivedReverse)
+		res.ReceivedReverse = &received
+	}
+	if e.CPU != nil {
+		cpu := CPU(*e.CPU)
+		res.CPU = &cpu
+	}
+	res.SenderCongestion = e.SenderTCPCongestion
+	res.ReceiverCongestion = e.ReceiverTCPCongestion
+}
+
+// decode applies a line of --json-stream or a -J document to res, sending
+// every interval to ws. It reports whether the test is over.
+func (res *Result) decode(o *output, ws Conn) bool {
+	switch o.Event {
+	case "":
+		if o.Start != nil {
+			res.start(o.Start)
+		}
+		for _, i := range o.Intervals {
+			res.interval(i, ws)
+		}
+		if o.End != nil {
+			res.end(o.End)
+		}
+		if o.Error != "" {
+			res.Err = o.Error
+		}
+		return true
+	case "start":
+		var s start
+		if json.Unmarshal(o.Data, &s) == nil {
+			res.start(&s)
+		}
+	case "interval":
+		var i interval
+		if json.Unmarshal(o.Data, &i) == nil {
+			res.interval(i, ws)
+		}
+	case "end":
+		var e end
+		if json.Unmarshal(o.Data, &e) == nil {
+			res.end(&e)
+		}
+		return true
+	case "error":
+		json.Unmarshal(o.Data, &res.Err)
+		return true
+	}
+	return false
+}
+
+// finish settles Success and the peak bitrate once the test is over.
+func (res *Result) finish() {
+	if res.Err != "" {
+		res.Success = false
+	}
+	for _, stat := range res.Stats {
+		if stat.Bitrate > res.Total.Peak {
+			res.Total.Peak = stat.Bitrate
+		}
+	}
+}
+
+// analyze reads iperf3's json output, the events of --json-stream as they
+// come or the document -J writes at exit, sending every interval to ws.
+func analyze(ctx context.Context, stdout io.Reader, ws Conn) (res Result) {
+	dec := json.NewDecoder(stdout)
+	for {
+		var o output
+		if err := dec.Decode(&o); err != nil {
+			if err != io.EOF && ctx.Err() == nil && res.Err == "" {
+				res.Err = "invalid iperf3 output: " + err.Error()
+			}
+			break
+		}
+		res.decode(&o, ws)
+	}
+	if err := ctx.Err(); err != nil {
+		res.Err = err.Error()
+	}
+	res.finish()
+	return
+}
@@ -0,0 +1,123 @@
+package iperf3
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// intervals counts the intervals analyze streams.
+type intervals struct{ n int }
+
+func (c *intervals) WriteJSON(v interface{}) error {
+	c.n++
+	return nil
+}
+
+func (c *intervals) Close() error { return nil }
+
+// fixture analyzes testdata/name, counting the intervals streamed.
+func fixture(t *testing.T, name string) (Result, int) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ws intervals
+	return analyze(context.Background(), f, &ws), ws.n
+}
+
+func TestAnalyze(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		check func(t *testing.T, res Result)
+	}{
+		{"tcp", func(t *testing.T, res Result) {
+			if res.Start.Protocol != "TCP" || res.Start.TCPMSS != 1448 || len(res.Start.Connected) != 1 {
+				t.Errorf("start %+v", res.Start)
+			}
+			if res.Total.Transfer != 235536384 || res.Total.Retr != 14 {
+				t.Errorf("total %+v", res.Total)
+			}
+			if res.Received == nil || res.Received.Bytes != 234225664 {
+				t.Errorf("received %+v", res.Received)
+			}
+			if len(res.Total.Streams) != 2 || !res.Total.Streams[0].Sender || res.Total.Streams[1].Sender {
+				t.Errorf("streams %+v", res.Total.Streams)
+			}
+			if res.Total.Streams[0].MeanRtt != 752 {
+				t.Errorf("mean rtt %d", res.Total.Streams[0].MeanRtt)
+			}
+			if res.Stats[1].Streams[0].Rtt != 874 || res.Stats[1].Streams[0].SndCwnd != 1447424 {
+				t.Errorf("interval %+v", res.Stats[1])
+			}
+			if res.SenderCongestion != "cubic" || res.ReceiverCongestion != "bbr" || res.CPU == nil {
+				t.Errorf("congestion %q %q cpu %v", res.SenderCongestion, res.ReceiverCongestion, res.CPU)
+			}
+		}},
+		{"udp", func(t *testing.T, res Result) {
+			if res.Start.Protocol != "UDP" || res.Start.Blksize != 1448 {
+				t.Errorf("start %+v", res.Start)
+			}
+			if res.Total.Sum.JitterMs != 0.021 || res.Total.Sum.LostPackets != 3 || res.Total.Sum.Packets != 1728 {
+				t.Errorf("total %+v", res.Total.Sum)
+			}
+			if len(res.Total.Streams) != 1 || res.Total.Streams[0].OutOfOrder != 1 {
+				t.Errorf("streams %+v", res.Total.Streams)
+			}
+			if res.Received == nil || res.Received.Packets != 1725 {
+				t.Errorf("received %+v", res.Received)
+			}
+		}},
+		{"bidir", func(t *testing.T, res Result) {
+			if !res.Start.Bidir || len(res.Start.Connected) != 2 {
+				t.Errorf("start %+v", res.Start)
+			}
+			if res.Stats[0].Reverse == nil || res.Stats[0].Reverse.Bytes != 61341696 || len(res.Stats[0].Streams) != 2 {
+				t.Errorf("interval %+v", res.Stats[0])
+			}
+			if res.Total.Transfer != 188743680 || res.Total.Reverse == nil || res.Total.Reverse.Bytes != 123731968 {
+				t.Errorf("total %+v", res.Total)
+			}
+			if res.SentReverse == nil || res.ReceivedReverse == nil || res.ReceivedReverse.Bytes != 122683392 {
+				t.Errorf("reverse %+v %+v", res.SentReverse, res.ReceivedReverse)
+			}
+			if len(res.Total.Streams) != 4 {
+				t.Errorf("%d streams, want 4", len(res.Total.Streams))
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, n := fixture(t, tc.name+".json")
+			if !doc.Success || doc.Err != "" {
+				t.Fatalf("test failed: %q", doc.Err)
+			}
+			if n != 2 || len(doc.Stats) != 2 {
+				t.Fatalf("%d intervals streamed, %d kept, want 2", n, len(doc.Stats))
+			}
+			if doc.Total.Peak == 0 {
+				t.Error("no peak bitrate")
+			}
+			tc.check(t, doc)
+			stream, n := fixture(t, tc.name+".jsonl")
+			if n != 2 {
+				t.Fatalf("%d intervals streamed from --json-stream, want 2", n)
+			}
+			if !reflect.DeepEqual(doc, stream) {
+				t.Fatalf("--json-stream differs from -J:\n%+v\n%+v", stream, doc)
+			}
+		})
+	}
+}
+
+func TestAnalyzeError(t *testing.T) {
+	for _, name := range []string{"refused.json", "refused.jsonl"} {
+		res, _ := fixture(t, name)
+		if res.Success || res.Start != nil || res.Err == "" {
+			t.Errorf("%s: got %+v", name, res)
+		}
+	}
+}
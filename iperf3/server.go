@@ -0,0 +1,330 @@
+package iperf3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerRunning  = errors.New("an iperf3 server already runs on this port")
+	ErrNoServer       = errors.New("no iperf3 server on this port")
+	ErrTooManyServers = errors.New("too many iperf3 servers")
+)
+
+const (
+	// restartWait is the pause before restarting a crashed server.
+	restartWait = time.Second
+	// crashLoop is how many times in a row a server may exit within
+	// crashUptime before it is given up.
+	crashLoop   = 3
+	crashUptime = 10 * time.Second
+)
+
+// ServerOptions configures a managed iperf3 server. Once serves a single
+// test (-1) and Idle, when set, stops the server after that long without a
+// test.
+type ServerOptions struct {
+	Port int
+	Once bool
+	Idle time.Duration
+}
+
+// ServerStatus describes a managed server. Err tells why it last exited,
+// Results are those of its last tests.
+type ServerStatus struct {
+	Port     int
+	Once     bool
+	Idle     int `json:",omitempty"`
+	Running  bool
+	Pid      int `json:",omitempty"`
+	Started  time.Time
+	LastTest *time.Time `json:",omitempty"`
+	Tests    int
+	Restarts int
+	Err      string   `json:",omitempty"`
+	Results  []Result `json:",omitempty"`
+}
+
+// Servers manages iperf3 servers by port. A server keeps its status after
+// it stopped until Stop removes it or a new one is started on its port.
+type Servers struct {
+	// Max is the number of servers running at once, 0 is unlimited.
+	Max int
+	// Results is the number of results kept per server.
+	Results int
+
+	mu      sync.Mutex
+	servers map[int]*server
+}
+
+var DefaultServers = &Servers{Max: 4, Results: 10}
+
+type server struct {
+	opt    ServerOptions
+	status ServerStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+	// read is closed when the output of the current process is consumed
+	read chan struct{}
+	// busy is set while a test runs, lastActive when it ended
+	busy       bool
+	lastActive time.Time
+}
+
+// Start starts a server, the returned status is taken right after the
+// iperf3 process started.
+func (s *Servers) Start(opt ServerOptions) (ServerStatus, error) {
+	if opt.Port == 0 {
+		opt.Port = 5201
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers == nil {
+		s.servers = map[int]*server{}
+	}
+	if sv, ok := s.servers[opt.Port]; ok && sv.status.Running {
+		return sv.status, ErrServerRunning
+	}
+	running := 0
+	for _, sv := range s.servers {
+		if sv.status.Running {
+			running++
+		}
+	}
+	if s.Max > 0 && running >= s.Max {
+		return ServerStatus{}, ErrTooManyServers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sv := &server{
+		opt:    opt,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: ServerStatus{
+			Port: opt.Port,
+			Once: opt.Once,
+			Idle: int(opt.Idle / time.Second),
+		},
+	}
+	cmd, stderr, err := s.spawn(sv)
+	if err != nil {
+		cancel()
+		return ServerStatus{}, err
+	}
+	s.servers[opt.Port] = sv
+	go s.run(ctx, sv, cmd, stderr)
+	return sv.status, nil
+}
+
+// Stop stops the server on port and forgets it.
+func (s *Servers) Stop(port int) error {
+	s.mu.Lock()
+	sv, ok := s.servers[port]
+	delete(s.servers, port)
+	s.mu.Unlock()
+	if !ok {
+		return ErrNoServer
+	}
+	sv.cancel()
+	<-sv.done
+	return nil
+}
+
+// Shutdown stops every server.
+func (s *Servers) Shutdown() {
+	s.mu.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.mu.Unlock()
+	for _, sv := range servers {
+		sv.cancel()
+	}
+	for _, sv := range servers {
+		<-sv.done
+	}
+}
+
+// Status returns the status of every server ordered by port.
+func (s *Servers) Status() []ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]ServerStatus, 0, len(s.servers))
+	for _, sv := range s.servers {
+		st := sv.status
+		st.Results = append([]Result(nil), st.Results...)
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Port < res[j].Port
+	})
+	return res
+}
+
+// spawn starts the iperf3 process of sv, s.mu must be held.
+func (s *Servers) spawn(sv *server) (*exec.Cmd, *bytes.Buffer, error) {
+	Args := []string{"-s", "-p", strconv.Itoa(sv.opt.Port)}
+	if hasJSONStream() {
+		Args = append(Args, "--json-stream", "--forceflush")
+	} else {
+		Args = append(Args, "-J")
+	}
+	if sv.opt.Once {
+		Args = append(Args, "-1")
+	}
+	cmd := exec.Command(binary(), Args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	sv.status.Running = true
+	sv.status.Pid = cmd.Process.Pid
+	sv.status.Started = now
+	sv.busy = false
+	sv.lastActive = now
+	sv.read = make(chan struct{})
+	go s.read(sv, stdout, sv.read)
+	return cmd, stderr, nil
+}
+
+// read records the results iperf3 writes, one document per test with -J or
+// the events of every test with --json-stream.
+func (s *Servers) read(sv *server, stdout io.Reader, done chan struct{}) {
+	defer close(done)
+	defer io.Copy(io.Discard, stdout)
+	dec := json.NewDecoder(stdout)
+	var res Result
+	for {
+		var o output
+		if err := dec.Decode(&o); err != nil {
+			return
+		}
+		if o.Event == "start" {
+			s.mu.Lock()
+			sv.busy = true
+			s.mu.Unlock()
+		}
+		if !res.decode(&o, nil) {
+			continue
+		}
+		res.finish()
+		now := time.Now()
+		s.mu.Lock()
+		sv.busy = false
+		sv.lastActive = now
+		sv.status.LastTest = &now
+		sv.status.Tests++
+		sv.status.Results = append(sv.status.Results, res)
+		if n := len(sv.status.Results) - s.Results; s.Results > 0 && n > 0 {
+			sv.status.Results = sv.status.Results[n:]
+		}
+		s.mu.Unlock()
+		res = Result{}
+	}
+}
+
+// idle reports whether sv went without a test for longer than its Idle.
+func (s *Servers) idle(sv *server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sv.opt.Idle > 0 && !sv.busy && time.Since(sv.lastActive) > sv.opt.Idle
+}
+
+// run watches the iperf3 process of sv until ctx is done, the server idled,
+// served its single test or keeps crashing, restarting it otherwise.
+func (s *Servers) run(ctx context.Context, sv *server, cmd *exec.Cmd, stderr *bytes.Buffer) {
+	defer close(sv.done)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	crashes := 0
+	for {
+		runCtx, stop := context.WithCancel(ctx)
+		exited := make(chan struct{})
+		waited := make(chan error, 1)
+		go func(cmd *exec.Cmd, read chan struct{}) {
+			<-read
+			waited <- cmd.Wait()
+		}(cmd, sv.read)
+		go terminate(runCtx, cmd, exited)
+		var err error
+		reason := ""
+	wait:
+		for {
+			select {
+			case err = <-waited:
+				break wait
+			case <-tick.C:
+				if reason == "" && s.idle(sv) {
+					reason = "idle"
+					stop()
+				}
+			}
+		}
+		close(exited)
+		stop()
+
+		s.mu.Lock()
+		sv.status.Running = false
+		sv.status.Pid = 0
+		switch {
+		case ctx.Err() != nil:
+			s.mu.Unlock()
+			return
+		case reason != "":
+			sv.status.Err = reason
+			s.mu.Unlock()
+			return
+		case sv.opt.Once && err == nil:
+			s.mu.Unlock()
+			return
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" && err != nil {
+			msg = err.Error()
+		}
+		if time.Since(sv.status.Started) < crashUptime {
+			crashes++
+		} else {
+			crashes = 0
+		}
+		if crashes >= crashLoop {
+			sv.status.Err = "crashed: " + msg
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartWait):
+		}
+		s.mu.Lock()
+		if ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		cmd, stderr, err = s.spawn(sv)
+		if err != nil {
+			sv.status.Err = "restart: " + err.Error()
+			s.mu.Unlock()
+			return
+		}
+		sv.status.Restarts++
+		sv.status.Err = msg
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"neko-exporter/jobs"
+	"neko-exporter/ping"
+	"neko-exporter/sched"
+
+	"github.com/gin-gonic/gin"
+)
+
+var jobManager *jobs.Manager
+
+func loadJobs() {
+	ttl := time.Duration(Config.Jobs.Ttl) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	jobManager = jobs.NewManager(baseCtx, ttl)
+}
+
+// probeJob waits for a slot of the probe's scheduler, recording the queue
+// position, before running f.
+func probeJob(probe string, f func(ctx context.Context, r *jobs.Recorder) (interface{}, error)) jobs.Func {
+	return func(ctx context.Context, r *jobs.Recorder) (interface{}, error) {
+		release, err := schedulers[probe].Acquire(ctx, func(s sched.State) {
+			r.Queued(s)
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		r.Running()
+		return f(ctx, r)
+	}
+}
+
+// pingRecorder keeps the last result a ping writes to the job.
+type pingRecorder struct {
+	*jobs.Recorder
+	last ping.Result
+}
+
+func (r *pingRecorder) WriteJSON(v interface{}) error {
+	if res, ok := v.(ping.Result); ok {
+		r.last = res
+	}
+	return r.Recorder.WriteJSON(v)
+}
+
+// jobScopes are the job types and the scopes they need.
+var jobScopes = map[string]string{
+	"mtr":    SCOPE_MTR,
+	"ping":   SCOPE_PING,
+	"iperf3": SCOPE_IPERF3,
+}
+
+// JobCreate starts a probe in the background. It takes the type (mtr, ping
+// or iperf3) and the form parameters of the synchronous endpoint, whose
+// rate limits apply.
+func JobCreate(c *gin.Context) {
+	typ := c.PostForm("type")
+	scope, ok := jobScopes[typ]
+	if !ok {
+		resp(c, false, "Unknown job type", 400)
+		return
+	}
+	key := c.MustGet("key").(*apiKey)
+	if !key.can(scope) {
+		resp(c, false, "Api key lacks scope "+scope, 403)
+		return
+	}
+	if !allow(c, "/"+typ) {
+		return
+	}
+	var f jobs.Func
+	switch typ {
+	case "mtr":
+		q, err := parseMtr(c.PostForm)
+		if err != nil {
+			resp(c, false, err.Error(), 400)
+			return
+		}
+		q.unmasked = unmasked(c)
+		if q.host = resolvePreferred(c, q.host, q.networks()...); q.host == "" {
+			return
+		}
+		f = probeJob(typ, func(ctx context.Context, r *jobs.Recorder) (interface{}, error) {
+			return q.run(ctx, r)
+		})
+	case "ping":
+		q, err := parsePing(c.PostForm)
+		if err != nil {
+			resp(c, false, err.Error(), 400)
+			return
+		}
+		if q.host = resolveTarget(c, "ip", q.host); q.host == "" {
+			return
+		}
+		f = probeJob(typ, func(ctx context.Context, r *jobs.Recorder) (interface{}, error) {
+			// the streaming variant leaves partial results in r, the last
+			// one written is the final result
+			pr := &pingRecorder{Recorder: r}
+			ping.PingWs(ctx, q.host, q.port, q.count, q.interval, q.timeout, q.protocol, pr)
+			if pr.last.Err != "" {
+				return pr.last, errors.New(pr.last.Err)
+			}
+			return pr.last, nil
+		})
+	case "iperf3":
+		q, err := parseIperf3(c.PostForm, 10)
+		if err != nil {
+			resp(c, false, err.Error(), 400)
+			return
+		}
+		if q.Host = resolveTarget(c, q.network(), q.Host); q.Host == "" {
+			return
+		}
+		f = probeJob(typ, func(ctx context.Context, r *jobs.Recorder) (interface{}, error) {
+			r.Append = true
+			return q.run(ctx, r)
+		})
+	}
+	id := jobManager.Start(typ, key.name, f)
+	resp(c, true, gin.H{"id": id}, 202)
+}
+
+// job returns the job of the url owned by the request's key, answering 404
+// otherwise.
+func job(c *gin.Context) (jobs.Job, bool) {
+	j, ok := jobManager.Get(c.Param("id"))
+	if !ok || j.Owner != c.MustGet("key").(*apiKey).name {
+		resp(c, false, "Job not found", 404)
+		return j, false
+	}
+	return j, true
+}
+
+func JobGet(c *gin.Context) {
+	if j, ok := job(c); ok {
+		resp(c, true, j, 200)
+	}
+}
+
+func JobCancel(c *gin.Context) {
+	if j, ok := job(c); ok {
+		jobManager.Cancel(j.ID)
+		resp(c, true, nil, 200)
+	}
+}
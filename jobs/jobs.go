@@ -0,0 +1,185 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	QUEUED    = "queued"
+	RUNNING   = "running"
+	DONE      = "done"
+	FAILED    = "failed"
+	CANCELLED = "cancelled"
+)
+
+// Job is a probe running in the background. Result holds the latest partial
+// result while it runs and the final one afterwards.
+type Job struct {
+	ID       string
+	Type     string
+	Owner    string `json:"-"`
+	Status   string
+	Queue    interface{} `json:",omitempty"`
+	Result   interface{} `json:",omitempty"`
+	Err      string      `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// Func runs a job. It streams partial results through the Recorder and
+// returns the final result.
+type Func func(ctx context.Context, r *Recorder) (interface{}, error)
+
+// Manager keeps the jobs, finished ones for TTL.
+type Manager struct {
+	TTL time.Duration
+
+	ctx  context.Context
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewManager returns a Manager whose jobs are cancelled along with ctx.
+func NewManager(ctx context.Context, ttl time.Duration) *Manager {
+	m := &Manager{TTL: ttl, ctx: ctx, jobs: map[string]*Job{}}
+	go m.expire()
+	return m
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start runs f in the background and returns the job's id.
+func (m *Manager) Start(typ, owner string, f Func) string {
+	ctx, cancel := context.WithCancel(m.ctx)
+	j := &Job{
+		ID:      newID(),
+		Type:    typ,
+		Owner:   owner,
+		Status:  QUEUED,
+		Created: time.Now(),
+		cancel:  cancel,
+	}
+	m.mu.Lock()
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		res, err := f(ctx, &Recorder{m: m, job: j})
+		now := time.Now()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		j.Finished = &now
+		j.Queue = nil
+		if res != nil {
+			j.Result = res
+		}
+		switch {
+		case ctx.Err() != nil:
+			j.Status = CANCELLED
+		case err != nil:
+			j.Status = FAILED
+			j.Err = err.Error()
+		default:
+			j.Status = DONE
+		}
+	}()
+	return j.ID
+}
+
+// Get returns a copy of the job.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Cancel stops a queued or running job, it reports whether the job exists.
+func (m *Manager) Cancel(id string) bool {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if ok {
+		j.cancel()
+	}
+	return ok
+}
+
+// Wait blocks until every started job has finished.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) expire() {
+	for range time.Tick(time.Minute) {
+		m.mu.Lock()
+		for id, j := range m.jobs {
+			if j.Finished != nil && time.Since(*j.Finished) > m.TTL {
+				delete(m.jobs, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Recorder stands in for the websocket of the streaming probes and keeps
+// what they write as the job's partial result: the latest message, or all
+// of them with Append for probes streaming increments rather than
+// snapshots.
+type Recorder struct {
+	Append bool
+
+	m    *Manager
+	job  *Job
+	list []interface{}
+}
+
+func (r *Recorder) WriteJSON(v interface{}) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if r.Append {
+		r.list = append(r.list, v)
+		r.job.Result = append([]interface{}(nil), r.list...)
+	} else {
+		r.job.Result = v
+	}
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	return nil
+}
+
+// Queued records the queue state while the job waits for a slot.
+func (r *Recorder) Queued(state interface{}) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.job.Queue = state
+}
+
+// Running marks the job as started.
+func (r *Recorder) Running() {
+	now := time.Now()
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.job.Status = RUNNING
+	r.job.Started = &now
+	r.job.Queue = nil
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"neko-exporter/metrics"
+	"neko-exporter/push"
 	"neko-exporter/stat"
 
 	"github.com/gin-gonic/gin"
@@ -27,9 +35,10 @@ func main() {
 	var confpath string
 	var show_version bool
 	flag.StringVar(&confpath, "c", "", "config path")
-	flag.IntVar(&Config.Mode, "mode", 0, "access mode")
+	flag.IntVar(&Config.Mode, "mode", MODE_API, "mode, 0: api, 1: push, 2: api and push")
 	flag.StringVar(&Config.Key, "key", "", "access key")
 	flag.IntVar(&Config.Port, "port", 8080, "port")
+	flag.StringVar(&Config.Url, "url", "", "push url")
 	flag.BoolVar(&show_version, "v", false, "show version")
 	flag.Parse()
 
@@ -48,33 +57,126 @@ func main() {
 		fmt.Println("neko-exporter v1.1")
 		return
 	}
+	if Config.Stat.Resolution > 0 {
+		stat.Default.Resolution = time.Duration(Config.Stat.Resolution) * time.Millisecond
+	}
+	if Config.Stat.History > 0 {
+		stat.Default.History = Config.Stat.History
+	}
+	if Config.Stat.Disk.Mountpoints != nil {
+		stat.Disks.Mountpoints = Config.Stat.Disk.Mountpoints
+	}
+	if Config.Stat.Disk.IgnoreFstypes != nil {
+		stat.Disks.IgnoreFstypes = Config.Stat.Disk.IgnoreFstypes
+	}
+	if Config.Stat.Disk.IgnoreDevices != nil {
+		stat.Disks.IgnoreDevices = Config.Stat.Disk.IgnoreDevices
+	}
+	loadRateLimits()
+	stat.Counters = rejectedCounters
+	stat.Default.Start()
 	// go walled.MonitorWalled()
-	API()
+	switch Config.Mode {
+	case MODE_PUSH:
+		go stopOnSignal()
+		Push()
+	case MODE_BOTH:
+		pushing.Add(1)
+		go func() {
+			defer pushing.Done()
+			Push()
+		}()
+		API()
+	default:
+		API()
+	}
+}
+func Push() {
+	if Config.Url == "" {
+		log.Fatal("push mode needs url")
+	}
+	fmt.Println("Push url:", Config.Url)
+	p := push.Pusher{
+		Url:       Config.Url,
+		Key:       Config.Key,
+		Interval:  time.Duration(Config.Push.Interval) * time.Second,
+		Jitter:    time.Duration(Config.Push.Jitter) * time.Second,
+		Timeout:   time.Duration(Config.Push.Timeout) * time.Second,
+		SpoolSize: Config.Push.Spool,
+		Collect: func() (interface{}, error) {
+			return stat.GetStat()
+		},
+	}
+	p.Run(baseCtx)
 }
 func API() {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(checkKey)
-	r.GET("/stat", Stat)
-	r.GET("/mtr", Mtr)
-	r.GET("/mtrws", MtrWs)
-	r.GET("/iperf3", Iperf3)
-	r.GET("/iperf3ws", Iperf3Ws)
-	r.GET("/pingws")
-	r.GET("/walled", Stat)
+	if err := r.SetTrustedProxies(Config.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadKeys(); err != nil {
+		log.Fatal(err)
+	}
+	loadSchedulers()
+	loadJobs()
+	if err := loadMtr(); err != nil {
+		log.Fatal(err)
+	}
+	loadIperf3()
+	if err := serveThroughput(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTargets(); err != nil {
+		log.Fatal(err)
+	}
+	r.Use(checkKey, rateLimit)
+	r.GET("/stat", scope(SCOPE_STAT), Stat)
+	r.GET("/stat/history", scope(SCOPE_STAT), StatHistory)
+	r.GET("/statws", scope(SCOPE_STAT), StatWs)
+	r.GET("/metrics", scope(SCOPE_STAT), Metrics)
+	r.GET("/mtr", scope(SCOPE_MTR), Mtr)
+	r.GET("/mtrws", scope(SCOPE_MTR), MtrWs)
+	r.GET("/iperf3", scope(SCOPE_IPERF3), Iperf3)
+	r.GET("/iperf3ws", scope(SCOPE_IPERF3), Iperf3Ws)
+	r.GET("/iperf3/server", scope(SCOPE_IPERF3_SERVER), Iperf3ServerStatus)
+	r.POST("/iperf3/server", scope(SCOPE_IPERF3_SERVER), Iperf3ServerStart)
+	r.DELETE("/iperf3/server/:port", scope(SCOPE_IPERF3_SERVER), Iperf3ServerStop)
+	r.GET("/ping", scope(SCOPE_PING), Ping)
+	r.GET("/pingws", scope(SCOPE_PING), PingWs)
+	r.POST("/jobs", JobCreate)
+	r.GET("/jobs/:id", JobGet)
+	r.DELETE("/jobs/:id", JobCancel)
+	r.GET("/walled", scope(SCOPE_STAT), Stat)
 	fmt.Println("Api port:", Config.Port)
 	fmt.Println("Api key:", Config.Key)
-	r.Run(":" + strconv.Itoa(Config.Port))
-}
-func checkKey(c *gin.Context) {
-	if c.Request.Header.Get("key") == Config.Key || c.Query("key") == Config.Key {
-		c.Next()
-	} else {
-		resp(c, false, "Api key Incorrect", 500)
-		c.Abort()
+	for _, k := range Config.Keys {
+		fmt.Println("Api key:", k.Name, k.Scopes)
+	}
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(Config.Port),
+		Handler: r,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+	if Config.Tls.SelfSigned && (Config.Tls.Cert == "" || Config.Tls.Key == "") {
+		log.Fatal("tls self_signed needs cert and key paths to write to")
 	}
+	if Config.Tls.Cert == "" && Config.Tls.Key == "" {
+		serve(srv, srv.ListenAndServe)
+		return
+	}
+	certs, err := newCertStore(Config.Tls)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.TLSConfig = certs.config()
+	fmt.Println("Api tls:", Config.Tls.Cert)
+	serve(srv, func() error {
+		return srv.ListenAndServeTLS("", "")
+	})
 }
-
 func Stat(c *gin.Context) {
 	res, err := stat.GetStat()
 	if err == nil {
@@ -83,3 +185,68 @@ func Stat(c *gin.Context) {
 		resp(c, false, err, 500)
 	}
 }
+
+func StatHistory(c *gin.Context) {
+	resp(c, true, stat.Default.Recent(), 200)
+}
+
+// statWsMaxInterval bounds the interval of /statws, the least is the
+// sampler resolution.
+const statWsMaxInterval = 10 * time.Minute
+
+func StatWs(c *gin.Context) {
+	interval := time.Second
+	if interval < stat.Default.Resolution {
+		interval = stat.Default.Resolution
+	}
+	if v := c.Query("interval"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			resp(c, false, fmt.Sprintf("invalid interval %q", v), 400)
+			return
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	if interval < stat.Default.Resolution || interval > statWsMaxInterval {
+		resp(c, false, fmt.Sprintf("interval must be between %d and %d", stat.Default.Resolution.Milliseconds(), statWsMaxInterval.Milliseconds()), 400)
+		return
+	}
+	filter := stat.Filter{
+		Sections: split(c.Query("sections")),
+		Include:  split(c.Query("include")),
+		Exclude:  split(c.Query("exclude")),
+	}
+	if err := filter.Validate(); err != nil {
+		resp(c, false, err.Error(), 400)
+		return
+	}
+	ws, err := upgrade(c)
+	if err != nil {
+		return
+	}
+	defer ws.release()
+	stat.StatWs(c.Request.Context(), interval, filter, ws.Conn)
+}
+
+// split parses a comma separated query value.
+func split(s string) []string {
+	var res []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+func Metrics(c *gin.Context) {
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	if err := stat.WriteMetrics(w); err != nil {
+		resp(c, false, err.Error(), 500)
+		return
+	}
+	writeRateLimitMetrics(w)
+	w.Flush()
+	c.Data(200, metrics.ContentType, buf.Bytes())
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"neko-exporter/ipdb"
 	"neko-exporter/mtr"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -15,13 +21,252 @@ var upGrader = websocket.Upgrader{
 	},
 }
 
+// mtrMask is the masking policy of mtr results, mtrDB describes the hops
+// if databases are configured.
+var (
+	mtrMask *mtr.Mask
+	mtrDB   *ipdb.DB
+)
+
+const MTR_MULTIPATH = "multipath"
+
+// mtrQuery is an mtr run, family is the preferred one, 4 or 6. Unmasked
+// shows every hop. With flows set it is a multipath run along that many
+// flows.
+type mtrQuery struct {
+	host     string
+	family   int
+	unmasked bool
+	flows    int
+	mtr.Options
+}
+
+// msParam parses a duration given in milliseconds, def when empty.
+func msParam(get func(string) string, name string, def int) (time.Duration, error) {
+	v := get(name)
+	if v == "" {
+		return time.Duration(def) * time.Millisecond, nil
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func parseMtr(get func(string) string) (mtrQuery, error) {
+	conf := Config.Mtr
+	limits := conf.Limits
+	q := mtrQuery{host: get("host"), family: conf.Family}
+	q.Count, _ = strconv.Atoi(get("count"))
+	if q.Count == 0 {
+		q.Count = conf.Count
+	}
+	if q.Count < 1 || q.Count > limits.MaxCount {
+		return q, fmt.Errorf("count must be between 1 and %d", limits.MaxCount)
+	}
+	var err error
+	if q.Interval, err = msParam(get, "interval", conf.Interval); err != nil {
+		return q, err
+	}
+	if q.Interval < time.Duration(limits.MinInterval)*time.Millisecond || q.Interval > time.Minute {
+		return q, fmt.Errorf("interval must be between %d and 60000", limits.MinInterval)
+	}
+	if q.Timeout, err = msParam(get, "timeout", conf.Timeout); err != nil {
+		return q, err
+	}
+	if q.Timeout < 10*time.Millisecond || q.Timeout > time.Duration(limits.MaxTimeout)*time.Millisecond {
+		return q, fmt.Errorf("timeout must be between 10 and %d", limits.MaxTimeout)
+	}
+	q.MaxHops, _ = strconv.Atoi(get("max_hops"))
+	if q.MaxHops == 0 {
+		q.MaxHops = conf.MaxHops
+	}
+	if q.MaxHops < 1 || q.MaxHops > limits.MaxHops {
+		return q, fmt.Errorf("max_hops must be between 1 and %d", limits.MaxHops)
+	}
+	q.Size, _ = strconv.Atoi(get("size"))
+	if q.Size == 0 {
+		q.Size = conf.Size
+	}
+	if q.Size < 28 || q.Size > limits.MaxSize {
+		return q, fmt.Errorf("size must be between 28 and %d", limits.MaxSize)
+	}
+	q.Source = conf.Source
+	if src := get("source"); src != "" {
+		if !limits.AllowSource {
+			return q, errors.New("source may not be set")
+		}
+		if _, err := net.InterfaceByName(src); net.ParseIP(src) == nil && err != nil {
+			return q, fmt.Errorf("invalid source %q", src)
+		}
+		q.Source = src
+	}
+	switch mode := get("mode"); mode {
+	case "":
+	case MTR_MULTIPATH:
+		q.flows, _ = strconv.Atoi(get("flows"))
+		if q.flows == 0 {
+			q.flows = conf.Flows
+		}
+		if q.flows < 1 || q.flows > limits.MaxFlows {
+			return q, fmt.Errorf("flows must be between 1 and %d", limits.MaxFlows)
+		}
+	default:
+		return q, fmt.Errorf("unknown mode %q", mode)
+	}
+	q.PTR = conf.RDNS
+	if v := get("rdns"); v != "" {
+		q.PTR = v != "false" && v != "0"
+	}
+	if get("enrich") != "false" && get("enrich") != "0" {
+		q.DB = mtrDB
+	}
+	switch f := get("family"); f {
+	case "":
+	case "4", "6":
+		q.family, _ = strconv.Atoi(f)
+	default:
+		return q, fmt.Errorf("invalid family %q", f)
+	}
+	return q, nil
+}
+
+// networks are the address families to resolve the host in, the preferred
+// one first.
+func (q mtrQuery) networks() []string {
+	if q.family == 6 {
+		return []string{"ip6", "ip4"}
+	}
+	return []string{"ip4", "ip6"}
+}
+
+// run runs q for at most the configured time.
+func (q mtrQuery) run(ctx context.Context, ws mtr.Conn) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(Config.Mtr.Limits.MaxTime)*time.Second)
+	defer cancel()
+	mask := mtrMask
+	if q.unmasked {
+		mask = nil
+	}
+	if q.flows > 0 {
+		return mtr.Multipath(ctx, q.host, q.Options, q.flows, mask, ws)
+	}
+	return mtr.Mtr(ctx, q.host, q.Options, mask, ws)
+}
+
+// unmasked reports whether the key of c was granted unmasked mtr results,
+// the wildcard scope of the legacy key does not imply it. The open api of an
+// exporter without keys never does.
+func unmasked(c *gin.Context) bool {
+	k := c.MustGet("key").(*apiKey)
+	if k.name == "default" && k.secret == "" {
+		return false
+	}
+	return k.grants(SCOPE_MTR_UNMASKED)
+}
+
+// loadMtr fills in the mtr defaults and limits and builds the masking
+// policy.
+func loadMtr() error {
+	conf := &Config.Mtr
+	if conf.Count == 0 {
+		conf.Count = 10
+	}
+	if conf.Interval == 0 {
+		conf.Interval = int(mtr.INTERVAL / time.Millisecond)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = int(mtr.TIMEOUT / time.Millisecond)
+	}
+	if conf.MaxHops == 0 {
+		conf.MaxHops = mtr.MAX_HOPS
+	}
+	if conf.Size == 0 {
+		conf.Size = mtr.PACKET_SIZE
+	}
+	if conf.Family == 0 {
+		conf.Family = 4
+	}
+	if conf.Flows == 0 {
+		conf.Flows = 8
+	}
+	limits := &conf.Limits
+	if limits.MaxCount == 0 {
+		limits.MaxCount = 100
+	}
+	if limits.MinInterval == 0 {
+		limits.MinInterval = 100
+	}
+	if limits.MaxTimeout == 0 {
+		limits.MaxTimeout = 5000
+	}
+	if limits.MaxHops == 0 {
+		limits.MaxHops = 64
+	}
+	if limits.MaxSize == 0 {
+		limits.MaxSize = 1500
+	}
+	if limits.MaxTime == 0 {
+		limits.MaxTime = 300
+	}
+	if limits.MaxFlows == 0 {
+		limits.MaxFlows = 16
+	}
+	mask := conf.Mask
+	mtrMask = &mtr.Mask{Hops: mask.Hops, ASNs: mask.Asns, V4: mask.IPv4, V6: mask.IPv6}
+	if mask.Hops == 0 {
+		mtrMask.Hops = 5
+	}
+	if mask.IPv4 == 0 {
+		mtrMask.V4 = 24
+	}
+	if mask.IPv6 == 0 {
+		mtrMask.V6 = 48
+	}
+	if mtrMask.V4 < 0 || mtrMask.V4 > 32 || mtrMask.V6 < 0 || mtrMask.V6 > 128 {
+		return errors.New("mtr mask: invalid prefix length")
+	}
+	for _, p := range mask.Prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("mtr mask: %v", err)
+		}
+		mtrMask.Prefixes = append(mtrMask.Prefixes, n)
+	}
+	if enrich := conf.Enrich; len(enrich.Databases) > 0 {
+		db, err := ipdb.Open(enrich.Databases...)
+		if err != nil {
+			return fmt.Errorf("mtr enrich: %v", err)
+		}
+		if enrich.Cache != 0 {
+			db.Cache = enrich.Cache
+		}
+		mtrDB = db
+		mtrMask.DB = db
+	}
+	if len(mask.Asns) > 0 && mtrDB == nil {
+		return errors.New("mtr mask: asns need enrich databases")
+	}
+	return nil
+}
+
 func Mtr(c *gin.Context) {
-	host := c.PostForm("host")
-	count, _ := strconv.Atoi(c.PostForm("count"))
-	if count == 0 {
-		count = 10
+	q, err := parseMtr(c.PostForm)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
+	}
+	q.unmasked = unmasked(c)
+	if q.host = resolvePreferred(c, q.host, q.networks()...); q.host == "" {
+		return
+	}
+	release := acquire(c, "mtr")
+	if release == nil {
+		return
 	}
-	res, err := mtr.Mtr(host, count, true, nil)
+	defer release()
+	res, err := q.run(c.Request.Context(), nil)
 	if err == nil {
 		resp(c, true, res, 200)
 	} else {
@@ -30,14 +275,26 @@ func Mtr(c *gin.Context) {
 }
 
 func MtrWs(c *gin.Context) {
-	host := c.Query("host")
-	count, _ := strconv.Atoi(c.Query("count"))
-	if count == 0 {
-		count = 10
+	q, err := parseMtr(c.Query)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
 	}
-	ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	q.unmasked = unmasked(c)
+	if q.host = resolvePreferred(c, q.host, q.networks()...); q.host == "" {
+		return
+	}
+	ws, err := upgrade(c)
 	if err != nil {
 		return
 	}
-	mtr.Mtr(host, count, true, ws)
+	defer ws.release()
+	ctx, cancel := wsContext(ws)
+	defer cancel()
+	release := acquireWs(ctx, ws, "mtr")
+	if release == nil {
+		return
+	}
+	defer release()
+	q.run(ctx, ws)
 }
@@ -0,0 +1,64 @@
+package mtr
+
+import (
+	"neko-exporter/ipdb"
+	"net"
+	"strconv"
+)
+
+// Mask hides the hops near the source: the first Hops and, at any distance,
+// those inside Prefixes or originated by ASNs, as DB tells. A masked hop
+// keeps the first V4 or V6 bits of its address, shown as that network, and
+// loses its name and any longer prefix.
+type Mask struct {
+	Hops     int
+	Prefixes []*net.IPNet
+	ASNs     []uint32
+	DB       *ipdb.DB
+	V4       int
+	V6       int
+}
+
+// masks reports whether the hop n answering from ip is hidden.
+func (m *Mask) masks(n *Node, ip net.IP) bool {
+	if n.TTL <= m.Hops {
+		return true
+	}
+	asn := n.ASN
+	if asn == 0 && len(m.ASNs) > 0 && m.DB != nil {
+		// the run may not be enriched
+		asn = m.DB.Lookup(ip).ASN
+	}
+	for _, a := range m.ASNs {
+		if asn == a {
+			return true
+		}
+	}
+	for _, p := range m.Prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply masks n if the policy hides it.
+func (m *Mask) apply(n *Node) {
+	ip := net.ParseIP(n.Host)
+	if ip == nil || !m.masks(n, ip) {
+		return
+	}
+	bits, size := m.V4, 32
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		bits, size = m.V6, 128
+	}
+	n.Host = ip.Mask(net.CIDRMask(bits, size)).String() + "/" + strconv.Itoa(bits)
+	n.Name = ""
+	if _, p, err := net.ParseCIDR(n.Prefix); err == nil {
+		if ones, _ := p.Mask.Size(); ones > bits {
+			n.Prefix = ""
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package mtr
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -8,10 +9,9 @@ import (
 	"sync"
 	"time"
 
+	"neko-exporter/ipdb"
+
 	tm "github.com/buger/goterm"
-	"github.com/gorilla/websocket"
-	"github.com/tonobo/mtr/pkg/hop"
-	"github.com/tonobo/mtr/pkg/icmp"
 	"github.com/tonobo/mtr/pkg/mtr"
 )
 
@@ -22,6 +22,7 @@ type packet struct {
 
 type Node struct {
 	Host        string
+	Name        string `json:",omitempty"`
 	Sent        int
 	TTL         int
 	LossPercent float64
@@ -30,6 +31,7 @@ type Node struct {
 	Best        float64
 	Worst       float64
 	Packets     []packet
+	ipdb.Info
 }
 
 type Result struct {
@@ -45,97 +47,305 @@ var (
 	MAX_HOPS         = 64
 	MAX_UNKNOWN_HOPS = 10
 	RING_BUFFER_SIZE = 50
+	PACKET_SIZE      = 64
 	PTR_LOOKUP       = false
 	srcAddr          = ""
 )
 
-func packets(h *hop.HopStatistic) []packet {
-	v := make([]packet, 0, h.RingBufferSize)
-	h.Packets.Do(func(f interface{}) {
-		if f == nil {
-			return
-		}
-		x := f.(icmp.ICMPReturn)
-		if x.Success {
-			v = append(v, packet{
-				Success: true,
-				Respond: x.Elapsed.Seconds() * 1000,
-			})
-		} else {
-			v = append(v, packet{
-				Success: false,
-				Respond: 0.0,
-			})
+// Options of a run, zero values take the package defaults. Interval is the
+// pause between rounds, Timeout how long a probe waits for its answer and
+// Size the packet size in bytes including the ip and icmp headers. Source
+// is a local address or interface to probe from, PTR looks up the names of
+// the hops and DB, when set, their AS, prefix and country.
+type Options struct {
+	Count    int
+	Interval time.Duration
+	Timeout  time.Duration
+	MaxHops  int
+	Size     int
+	Source   string
+	PTR      bool
+	DB       *ipdb.DB
+}
+
+func (opt *Options) defaults() {
+	if opt.Count == 0 {
+		opt.Count = 10
+	}
+	if opt.Interval == 0 {
+		opt.Interval = INTERVAL
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = TIMEOUT
+	}
+	if opt.MaxHops == 0 {
+		opt.MaxHops = MAX_HOPS
+	}
+	if opt.Size == 0 {
+		opt.Size = PACKET_SIZE
+	}
+	if opt.Source == "" {
+		opt.Source = srcAddr
+	}
+}
+
+// hop is the statistic of a ttl. target answered the latest probe, it
+// changes when the route balances the probes over several paths. packets
+// holds the newest first.
+type hop struct {
+	ttl     int
+	target  string
+	sent    int
+	lost    int
+	last    reply
+	best    reply
+	worst   reply
+	sum     time.Duration
+	packets []packet
+}
+
+func (h *hop) add(r reply) {
+	h.sent++
+	h.last = r
+	if r.Success {
+		h.target = r.Addr
+	}
+	p := packet{Success: r.Success}
+	if r.Success {
+		p.Respond = r.Elapsed.Seconds() * 1000
+	}
+	h.packets = append([]packet{p}, h.packets...)
+	if len(h.packets) > RING_BUFFER_SIZE {
+		h.packets = h.packets[:RING_BUFFER_SIZE]
+	}
+	if !r.Success {
+		h.lost++
+		return
+	}
+	if h.sum == 0 || r.Elapsed < h.best.Elapsed {
+		h.best = r
+	}
+	if r.Elapsed > h.worst.Elapsed {
+		h.worst = r
+	}
+	h.sum += r.Elapsed
+}
+
+// names looks the hops up in the background, so slow resolvers do not hold
+// the probes back.
+type names struct {
+	mu    sync.Mutex
+	names map[string]string
+	wg    sync.WaitGroup
+}
+
+func (n *names) lookup(ctx context.Context, addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.names[addr]; ok || addr == "" {
+		return
+	}
+	n.names[addr] = ""
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		if names, err := net.DefaultResolver.LookupAddr(ctx, addr); err == nil && len(names) > 0 {
+			n.mu.Lock()
+			n.names[addr] = strings.TrimSuffix(names[0], ".")
+			n.mu.Unlock()
 		}
-	})
-	return v
+	}()
+}
+
+func (n *names) get(addr string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.names[addr]
+}
+
+// sender sends the probes of a trace, see prober and udpProber.
+type sender interface {
+	probe(ttl int) reply
+}
+
+// trace is a run in progress, hops holds the statistic of ttl i at i-1.
+// Results are masked by mask, if set. The probing goroutine changes hops
+// under mu, others must hold it to read them.
+type trace struct {
+	dst   string
+	opt   Options
+	p     sender
+	mu    sync.Mutex
+	hops  []*hop
+	names *names
+	mask  *Mask
 }
 
-func toNode(h *hop.HopStatistic, hide bool) Node {
+func (t *trace) toNode(h *hop) Node {
 	node := Node{
-		Host:        h.Target,
-		Sent:        h.Sent,
-		TTL:         h.TTL,
-		LossPercent: h.Loss(),
-		Last:        h.Last.Elapsed.Seconds() * 1000,
-		Best:        h.Best.Elapsed.Seconds() * 1000,
-		Worst:       h.Worst.Elapsed.Seconds() * 1000,
-		Avg:         h.Avg(),
-		Packets:     packets(h),
-	}
-	if hide && node.Host != "" {
-		t := strings.Split(node.Host, ".")
-		if len(t) >= 1 {
-			t[len(t)-1] = "x"
-		}
-		if len(t) >= 2 {
-			t[len(t)-2] = "x"
-		}
-		node.Host = strings.Join(t, ".")
+		Host:        h.target,
+		Sent:        h.sent,
+		TTL:         h.ttl,
+		LossPercent: float64(h.lost) / float64(h.sent) * 100.0,
+		Last:        h.last.Elapsed.Seconds() * 1000,
+		Best:        h.best.Elapsed.Seconds() * 1000,
+		Worst:       h.worst.Elapsed.Seconds() * 1000,
+		Packets:     append([]packet(nil), h.packets...),
+	}
+	if ok := h.sent - h.lost; ok > 0 {
+		node.Avg = h.sum.Seconds() * 1000 / float64(ok)
+	}
+	if t.names != nil {
+		node.Name = t.names.get(h.target)
+	}
+	if ip := net.ParseIP(h.target); ip != nil && t.opt.DB != nil {
+		node.Info = t.opt.DB.Lookup(ip)
+	}
+	if t.mask != nil {
+		t.mask.apply(&node)
 	}
 	return node
 }
 
-func toRes(m *mtr.MTR) Result {
+func (t *trace) toRes() Result {
 	res := Result{
-		Host:      m.Address,
+		Host:      t.dst,
 		Statistic: make([]Node, 0),
 	}
-	for i := 1; i <= len(m.Statistic); i++ {
-		res.Statistic = append(res.Statistic, toNode(m.Statistic[i], i <= 5))
+	for _, h := range t.hops {
+		res.Statistic = append(res.Statistic, t.toNode(h))
 	}
 	return res
 }
 
-func Mtr(host string, count int, hide bool, ws *websocket.Conn) (res Result, err error) {
-	ips, er := net.LookupHost(host)
-	if er != nil {
+// Conn receives the streamed results, usually a *websocket.Conn.
+type Conn interface {
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// discover finds the hops, checking ctx before every one, so a cancelled
+// run stops within the timeout.
+func (t *trace) discover(ctx context.Context, emit func()) {
+	unknownHopsCount := 0
+	for ttl := 1; ttl <= t.opt.MaxHops; ttl++ {
+		if ctx.Err() != nil {
+			return
+		}
+		time.Sleep(HOP_SLEEP)
+		r := t.p.probe(ttl)
+		h := &hop{ttl: ttl}
+		h.add(r)
+		t.mu.Lock()
+		t.hops = append(t.hops, h)
+		t.mu.Unlock()
+		if t.names != nil {
+			t.names.lookup(ctx, r.Addr)
+		}
+		emit()
+		if r.Addr == t.dst {
+			break
+		}
+		if !r.Success {
+			unknownHopsCount++
+			if unknownHopsCount > MAX_UNKNOWN_HOPS {
+				break
+			}
+			continue
+		}
+		unknownHopsCount = 0
+	}
+}
+
+// run probes the hops Count times, checking ctx before every probe. Silent
+// hops are probed again, they may answer later. emit is called after each
+// probe from the same goroutine, so it may read t.
+func (t *trace) run(ctx context.Context, emit func()) {
+	t.discover(ctx, emit)
+	timer := time.NewTimer(t.opt.Interval)
+	defer timer.Stop()
+	for i := 1; i < t.opt.Count; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		for _, h := range t.hops {
+			if ctx.Err() != nil {
+				return
+			}
+			time.Sleep(HOP_SLEEP)
+			r := t.p.probe(h.ttl)
+			t.mu.Lock()
+			h.add(r)
+			t.mu.Unlock()
+			if t.names != nil {
+				t.names.lookup(ctx, r.Addr)
+			}
+			emit()
+		}
+		timer.Reset(t.opt.Interval)
+	}
+}
+
+// Mtr traces host, streaming the results to ws if set. Hops are masked by
+// mask, nil shows them all.
+func Mtr(ctx context.Context, host string, opt Options, mask *Mask, ws Conn) (res Result, err error) {
+	opt.defaults()
+	fail := func(er error) (Result, error) {
+		res.Host = host
 		res.Err = er.Error()
 		if ws != nil {
 			ws.WriteJSON(res)
 			ws.Close()
 		}
-		err = er
-		return
+		return res, er
 	}
-	m, ch, er := mtr.NewMTR(ips[0], srcAddr, TIMEOUT, INTERVAL, HOP_SLEEP, MAX_HOPS, MAX_UNKNOWN_HOPS, RING_BUFFER_SIZE, PTR_LOOKUP)
-	if er != nil {
-		err = er
-		return
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fail(err)
 	}
-	go func(ch chan struct{}) {
-		m.Run(ch, count)
+	p, err := newProber(ips[0].IP, opt.Source, opt.Size, opt.Timeout)
+	if err != nil {
+		return fail(err)
+	}
+	defer p.close()
+	t := &trace{dst: ips[0].IP.String(), opt: opt, p: p, mask: mask}
+	if opt.PTR {
+		t.names = &names{names: map[string]string{}}
+	}
+	// the results are built by the probing goroutine and handed over, the
+	// statistic must not be read while it probes
+	ch := make(chan Result, 1)
+	go func() {
+		t.run(ctx, func() {
+			if ws == nil {
+				return
+			}
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- t.toRes()
+		})
 		close(ch)
-	}(ch)
-	for range ch {
-		if ws != nil {
-			ws.WriteJSON(toRes(m))
-		}
+	}()
+	for r := range ch {
+		ws.WriteJSON(r)
+	}
+	if t.names != nil {
+		t.names.wg.Wait()
+	}
+	res = t.toRes()
+	if err = ctx.Err(); err != nil {
+		res.Err = err.Error()
 	}
 	if ws != nil {
+		ws.WriteJSON(res)
 		ws.Close()
 	}
-	res = toRes(m)
 	return
 }
 
@@ -0,0 +1,469 @@
+package mtr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpPort is the destination port of every flow, as in traceroute.
+const udpPort = 33434
+
+// Responder is a host answering at a ttl, with the flows that met it.
+type Responder struct {
+	Node
+	Flows []int
+}
+
+// MultiHop is a ttl of a multipath run and every host answering at it.
+type MultiHop struct {
+	TTL        int
+	Responders []Responder
+}
+
+// Path is a distinct path, the hosts Flows met at every ttl. Its loss and
+// latency are those of its last hop.
+type Path struct {
+	Flows       []int
+	Hosts       []string
+	Sent        int
+	LossPercent float64
+	Avg         float64
+	Best        float64
+	Worst       float64
+}
+
+// MultipathResult is a multipath run along Flows flows.
+type MultipathResult struct {
+	Host  string
+	Flows int
+	Hops  []MultiHop
+	Paths []Path
+	Err   string `json:",omitempty"`
+}
+
+// answer is an icmp error quoting a probe with the sequence number seq.
+type answer struct {
+	addr string
+	seq  int
+	at   time.Time
+}
+
+// udpFlows reads the icmp errors for the udp probes of every flow and hands
+// them to the flow whose source port they quote.
+type udpFlows struct {
+	conn  *icmp.PacketConn
+	v6    bool
+	dst   net.IP
+	src   string
+	mu    sync.Mutex
+	flows map[int]*udpProber
+}
+
+// udpProber sends the probes of one flow. Its source and destination ports
+// stay the same, so load balancers hash every probe onto the same path.
+// The sequence number is carried in the payload and, for routers quoting
+// only the udp header, as its checksum like Paris traceroute does.
+type udpProber struct {
+	conn    *net.UDPConn
+	setTTL  func(int) error
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	answers chan answer
+	seq     int
+	payload []byte
+	timeout time.Duration
+}
+
+func newUDPFlows(dst net.IP, src string) (*udpFlows, error) {
+	v6 := dst.To4() == nil
+	conn, src, err := listenICMP(src, v6)
+	if err != nil {
+		return nil, err
+	}
+	// the checksums cover the source address, find the one routed to dst
+	route, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(src)}, &net.UDPAddr{IP: dst, Port: udpPort})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	src = route.LocalAddr().(*net.UDPAddr).IP.String()
+	route.Close()
+	u := &udpFlows{conn: conn, v6: v6, dst: dst, src: src, flows: map[int]*udpProber{}}
+	go u.read()
+	return u, nil
+}
+
+// flow opens a flow sending packets of size bytes including the headers.
+func (u *udpFlows) flow(size int, timeout time.Duration) (*udpProber, error) {
+	network, header := "udp4", ipv4.HeaderLen
+	if u.v6 {
+		network, header = "udp6", ipv6.HeaderLen
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(u.src)})
+	if err != nil {
+		return nil, err
+	}
+	p := &udpProber{
+		conn:    conn,
+		src:     conn.LocalAddr().(*net.UDPAddr),
+		dst:     &net.UDPAddr{IP: u.dst, Port: udpPort},
+		answers: make(chan answer, 8),
+		timeout: timeout,
+	}
+	if u.v6 {
+		p.setTTL = ipv6.NewPacketConn(conn).SetHopLimit
+	} else {
+		p.setTTL = ipv4.NewPacketConn(conn).SetTTL
+	}
+	n := size - header - 8
+	if n < 4 {
+		n = 4
+	}
+	p.payload = make([]byte, n)
+	u.mu.Lock()
+	u.flows[conn.LocalAddr().(*net.UDPAddr).Port] = p
+	u.mu.Unlock()
+	return p, nil
+}
+
+func (u *udpFlows) close() {
+	u.conn.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, p := range u.flows {
+		p.conn.Close()
+	}
+}
+
+func (u *udpFlows) read() {
+	b := make([]byte, 1500)
+	for {
+		n, peer, err := u.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		port, seq, ok := u.quoted(b[:n])
+		if !ok {
+			continue
+		}
+		u.mu.Lock()
+		p := u.flows[port]
+		u.mu.Unlock()
+		if p == nil {
+			continue
+		}
+		select {
+		case p.answers <- answer{addr: peer.(*net.IPAddr).IP.String(), seq: seq, at: at}:
+		default:
+		}
+	}
+}
+
+// quoted returns the source port and sequence number of the probe the
+// icmp error b quotes.
+func (u *udpFlows) quoted(b []byte) (port, seq int, ok bool) {
+	proto := 1
+	if u.v6 {
+		proto = 58
+	}
+	m, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return
+	}
+	var inner []byte
+	switch body := m.Body.(type) {
+	case *icmp.TimeExceeded:
+		inner = body.Data
+	case *icmp.DstUnreach:
+		inner = body.Data
+	default:
+		return
+	}
+	var udp []byte
+	if u.v6 {
+		if len(inner) < ipv6.HeaderLen || inner[6] != 17 || !bytes.Equal(inner[24:40], u.dst.To16()) {
+			return
+		}
+		udp = inner[ipv6.HeaderLen:]
+	} else {
+		if len(inner) < ipv4.HeaderLen || inner[9] != 17 || !bytes.Equal(inner[16:20], u.dst.To4()) {
+			return
+		}
+		udp = inner[int(inner[0]&0x0f)*4:]
+	}
+	if len(udp) < 8 || binary.BigEndian.Uint16(udp[2:]) != udpPort {
+		return
+	}
+	// locally generated errors quote the whole packet, whose checksum may
+	// be left to the nic
+	seq = int(binary.BigEndian.Uint16(udp[6:]))
+	if len(udp) >= 10 {
+		seq = int(binary.BigEndian.Uint16(udp[8:]))
+	}
+	return int(binary.BigEndian.Uint16(udp)), seq, true
+}
+
+// sum16 adds b to sum as big endian 16 bit words, padding an odd byte.
+func sum16(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// fold reduces sum to 16 bits in ones' complement.
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// stamp puts seq, from 1 to 0xfffe, at the start of the payload and sets
+// the next word so the udp checksum of the probe comes out as seq.
+func (p *udpProber) stamp(seq int) {
+	binary.BigEndian.PutUint16(p.payload, uint16(seq))
+	binary.BigEndian.PutUint16(p.payload[2:], 0)
+	length := 8 + len(p.payload)
+	var sum uint32
+	if ip4 := p.src.IP.To4(); ip4 != nil {
+		sum = sum16(sum16(sum, ip4), p.dst.IP.To4())
+	} else {
+		sum = sum16(sum16(sum, p.src.IP.To16()), p.dst.IP.To16())
+	}
+	sum += 17 + uint32(length)
+	sum += uint32(p.src.Port) + uint32(p.dst.Port) + uint32(length)
+	sum = sum16(sum, p.payload)
+	// the checksum is the complement of the sum, which the word adds to
+	binary.BigEndian.PutUint16(p.payload[2:], fold(uint32(^uint16(seq))+uint32(^fold(sum))))
+}
+
+func (p *udpProber) probe(ttl int) (r reply) {
+	p.seq = p.seq%0xfffe + 1
+	if err := p.setTTL(ttl); err != nil {
+		return
+	}
+	p.stamp(p.seq)
+	// forget answers to earlier probes that came in late
+	for len(p.answers) > 0 {
+		<-p.answers
+	}
+	start := time.Now()
+	if _, err := p.conn.WriteToUDP(p.payload, p.dst); err != nil {
+		return
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case a := <-p.answers:
+			if a.seq != p.seq {
+				continue
+			}
+			return reply{Success: true, Addr: a.addr, Elapsed: a.at.Sub(start)}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// merge adds the numbers of o to h, leaving out the packets.
+func (h *hop) merge(o *hop) {
+	if o.sent > o.lost {
+		if h.sent == h.lost || o.best.Elapsed < h.best.Elapsed {
+			h.best = o.best
+		}
+		if o.worst.Elapsed > h.worst.Elapsed {
+			h.worst = o.worst
+		}
+	}
+	h.sent += o.sent
+	h.lost += o.lost
+	h.sum += o.sum
+	h.last = o.last
+}
+
+// multipathRes sums the flows up by ttl and by path. The flows share their
+// names, database and mask, those of the first one are used.
+func multipathRes(dst string, traces []*trace) MultipathResult {
+	res := MultipathResult{
+		Host:  dst,
+		Flows: len(traces),
+		Hops:  make([]MultiHop, 0),
+		Paths: make([]Path, 0),
+	}
+	flows := make([][]hop, len(traces))
+	for i, t := range traces {
+		t.mu.Lock()
+		for _, h := range t.hops {
+			flows[i] = append(flows[i], *h)
+		}
+		t.mu.Unlock()
+	}
+	t := traces[0]
+	// hosts maps the target of a hop to how it is shown, by ttl
+	var hosts []map[string]string
+	for ttl := 1; ; ttl++ {
+		var merged []*hop
+		var met [][]int
+		index := map[string]int{}
+		for f, hops := range flows {
+			if len(hops) < ttl {
+				continue
+			}
+			h := &hops[ttl-1]
+			i, ok := index[h.target]
+			if !ok {
+				i = len(merged)
+				index[h.target] = i
+				merged = append(merged, &hop{ttl: ttl, target: h.target})
+				met = append(met, nil)
+			}
+			merged[i].merge(h)
+			met[i] = append(met[i], f)
+		}
+		if len(merged) == 0 {
+			break
+		}
+		mh := MultiHop{TTL: ttl}
+		shown := map[string]string{}
+		for i, h := range merged {
+			node := t.toNode(h)
+			shown[h.target] = node.Host
+			mh.Responders = append(mh.Responders, Responder{Node: node, Flows: met[i]})
+		}
+		hosts = append(hosts, shown)
+		res.Hops = append(res.Hops, mh)
+	}
+
+	index := map[string]int{}
+	var last []*hop
+	for f, hops := range flows {
+		if len(hops) == 0 {
+			continue
+		}
+		targets := make([]string, len(hops))
+		for i, h := range hops {
+			targets[i] = h.target
+		}
+		key := strings.Join(targets, ",")
+		i, ok := index[key]
+		if !ok {
+			i = len(res.Paths)
+			index[key] = i
+			p := Path{}
+			for ttl, target := range targets {
+				p.Hosts = append(p.Hosts, hosts[ttl][target])
+			}
+			res.Paths = append(res.Paths, p)
+			last = append(last, &hop{})
+		}
+		res.Paths[i].Flows = append(res.Paths[i].Flows, f)
+		last[i].merge(&hops[len(hops)-1])
+	}
+	for i, h := range last {
+		node := t.toNode(h)
+		p := &res.Paths[i]
+		p.Sent, p.LossPercent = node.Sent, node.LossPercent
+		p.Avg, p.Best, p.Worst = node.Avg, node.Best, node.Worst
+	}
+	return res
+}
+
+// Multipath traces host along flows flows at once, each from its own udp
+// source port, so load balancers spread them over their paths as they
+// spread connections, like Dublin traceroute does. It reports every host
+// answering at a ttl and the distinct paths, streaming the results to ws
+// if set. Hops are masked by mask, nil shows them all.
+func Multipath(ctx context.Context, host string, opt Options, flows int, mask *Mask, ws Conn) (res MultipathResult, err error) {
+	opt.defaults()
+	if flows < 1 {
+		flows = 1
+	}
+	fail := func(er error) (MultipathResult, error) {
+		res.Host = host
+		res.Err = er.Error()
+		if ws != nil {
+			ws.WriteJSON(res)
+			ws.Close()
+		}
+		return res, er
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fail(err)
+	}
+	u, err := newUDPFlows(ips[0].IP, opt.Source)
+	if err != nil {
+		return fail(err)
+	}
+	defer u.close()
+	dst := ips[0].IP.String()
+	var n *names
+	if opt.PTR {
+		n = &names{names: map[string]string{}}
+	}
+	traces := make([]*trace, flows)
+	for i := range traces {
+		p, err := u.flow(opt.Size, opt.Timeout)
+		if err != nil {
+			return fail(err)
+		}
+		traces[i] = &trace{dst: dst, opt: opt, p: p, names: n, mask: mask}
+	}
+	changed := make(chan struct{}, 1)
+	emit := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	var wg sync.WaitGroup
+	for _, t := range traces {
+		wg.Add(1)
+		go func(t *trace) {
+			defer wg.Done()
+			t.run(ctx, emit)
+		}(t)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-changed:
+			if ws != nil {
+				ws.WriteJSON(multipathRes(dst, traces))
+			}
+		case <-done:
+			running = false
+		}
+	}
+	if n != nil {
+		n.wg.Wait()
+	}
+	res = multipathRes(dst, traces)
+	if err = ctx.Err(); err != nil {
+		res.Err = err.Error()
+	}
+	if ws != nil {
+		ws.WriteJSON(res)
+		ws.Close()
+	}
+	return
+}
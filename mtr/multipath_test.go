@@ -0,0 +1,118 @@
+package mtr
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpChecksum computes the checksum of the udp packet of p as the kernel
+// would.
+func udpChecksum(p *udpProber) uint16 {
+	length := 8 + len(p.payload)
+	var b []byte
+	if ip4 := p.src.IP.To4(); ip4 != nil {
+		b = append(append(b, ip4...), p.dst.IP.To4()...)
+	} else {
+		b = append(append(b, p.src.IP.To16()...), p.dst.IP.To16()...)
+	}
+	b = append(b, 0, 17, byte(length>>8), byte(length))
+	b = append(b, byte(p.src.Port>>8), byte(p.src.Port), byte(p.dst.Port>>8), byte(p.dst.Port))
+	b = append(b, byte(length>>8), byte(length), 0, 0)
+	b = append(b, p.payload...)
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	if c := ^uint16(sum); c != 0 {
+		return c
+	}
+	return 0xffff
+}
+
+func TestStamp(t *testing.T) {
+	for _, tc := range []struct{ src, dst string }{
+		{"192.0.2.2", "198.51.100.7"},
+		{"2001:db8::2", "2001:db8:1::7"},
+	} {
+		for _, size := range []int{10, 11, 36} {
+			p := &udpProber{
+				src:     &net.UDPAddr{IP: net.ParseIP(tc.src), Port: 40123},
+				dst:     &net.UDPAddr{IP: net.ParseIP(tc.dst), Port: udpPort},
+				payload: make([]byte, size),
+			}
+			for i := range p.payload[4:] {
+				p.payload[4+i] = byte(i * 7)
+			}
+			for _, seq := range []int{1, 2, 0x1234, 0x8000, 0xfffe} {
+				p.stamp(seq)
+				if sum := udpChecksum(p); int(sum) != seq {
+					t.Errorf("%s, %d bytes: checksum %#x, want %#x", tc.dst, size, sum, seq)
+				}
+			}
+		}
+	}
+}
+
+// timeExceeded is the icmp error of a router quoting n bytes of the udp
+// packet of p.
+func timeExceeded(t *testing.T, p *udpProber, n int) []byte {
+	t.Helper()
+	udp := make([]byte, 8, 8+len(p.payload))
+	binary.BigEndian.PutUint16(udp, uint16(p.src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(p.dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(p.payload)))
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(p))
+	udp = append(udp, p.payload...)[:n]
+	var inner []byte
+	var typ icmp.Type = ipv4.ICMPTypeTimeExceeded
+	if ip4 := p.dst.IP.To4(); ip4 != nil {
+		inner = make([]byte, ipv4.HeaderLen)
+		inner[0], inner[9] = 0x45, 17
+		copy(inner[12:], p.src.IP.To4())
+		copy(inner[16:], ip4)
+	} else {
+		typ = ipv6.ICMPTypeTimeExceeded
+		inner = make([]byte, ipv6.HeaderLen)
+		inner[0], inner[6] = 0x60, 17
+		copy(inner[8:], p.src.IP.To16())
+		copy(inner[24:], p.dst.IP.To16())
+	}
+	b, err := (&icmp.Message{Type: typ, Body: &icmp.TimeExceeded{Data: append(inner, udp...)}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestQuoted(t *testing.T) {
+	for _, tc := range []struct{ src, dst string }{
+		{"192.0.2.2", "198.51.100.7"},
+		{"2001:db8::2", "2001:db8:1::7"},
+	} {
+		p := &udpProber{
+			src:     &net.UDPAddr{IP: net.ParseIP(tc.src), Port: 40123},
+			dst:     &net.UDPAddr{IP: net.ParseIP(tc.dst), Port: udpPort},
+			payload: make([]byte, 36),
+		}
+		u := &udpFlows{v6: p.dst.IP.To4() == nil, dst: p.dst.IP}
+		p.stamp(0x0321)
+		// routers quoting only the udp header and those quoting more
+		for _, n := range []int{8, 8 + len(p.payload)} {
+			port, seq, ok := u.quoted(timeExceeded(t, p, n))
+			if !ok || port != p.src.Port || seq != 0x0321 {
+				t.Errorf("%s, %d bytes quoted: port %d seq %#x ok %v", tc.dst, n, port, seq, ok)
+			}
+		}
+	}
+}
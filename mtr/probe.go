@@ -0,0 +1,188 @@
+package mtr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// lastID makes the echo ids of concurrent runs differ, they all read every
+// icmp message the host receives.
+var lastID uint32
+
+// reply is the answer to a probe, Addr is the address it came from.
+type reply struct {
+	Success bool
+	Addr    string
+	Elapsed time.Duration
+}
+
+// prober sends echo requests with a given ttl from one raw socket and
+// matches the echo replies, time exceeded and unreachable messages by id
+// and sequence number.
+type prober struct {
+	conn    *icmp.PacketConn
+	v6      bool
+	dst     *net.IPAddr
+	id      int
+	seq     int
+	payload []byte
+	timeout time.Duration
+}
+
+// sourceAddr returns src if it is an address, or the first address of the
+// right family of the interface src.
+func sourceAddr(src string, v6 bool) (string, error) {
+	if src == "" || net.ParseIP(src) != nil {
+		return src, nil
+	}
+	ifi, err := net.InterfaceByName(src)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && (ipn.IP.To4() == nil) == v6 {
+			return ipn.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no address on %s", src)
+}
+
+// listenICMP opens the raw icmp socket of a family on src, an address or
+// interface, and returns the address it is bound to.
+func listenICMP(src string, v6 bool) (*icmp.PacketConn, string, error) {
+	src, err := sourceAddr(src, v6)
+	if err != nil {
+		return nil, "", err
+	}
+	network, addr := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, addr = "ip6:ipv6-icmp", "::"
+	}
+	if src != "" {
+		addr = src
+	}
+	conn, err := icmp.ListenPacket(network, addr)
+	return conn, src, err
+}
+
+// newProber probes dst from src, an address or interface, with packets of
+// size bytes including the ip and icmp headers.
+func newProber(dst net.IP, src string, size int, timeout time.Duration) (*prober, error) {
+	v6 := dst.To4() == nil
+	conn, _, err := listenICMP(src, v6)
+	if err != nil {
+		return nil, err
+	}
+	header := ipv4.HeaderLen
+	if v6 {
+		header = ipv6.HeaderLen
+	}
+	n := size - header - 8
+	if n < 0 {
+		n = 0
+	}
+	return &prober{
+		conn:    conn,
+		v6:      v6,
+		dst:     &net.IPAddr{IP: dst},
+		id:      int(uint32(os.Getpid())+atomic.AddUint32(&lastID, 1)) & 0xffff,
+		payload: make([]byte, n),
+		timeout: timeout,
+	}, nil
+}
+
+func (p *prober) close() {
+	p.conn.Close()
+}
+
+// probe sends an echo request with ttl and waits up to the timeout for its
+// answer.
+func (p *prober) probe(ttl int) (r reply) {
+	p.seq = (p.seq + 1) & 0xffff
+	seq := p.seq
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	var err error
+	if p.v6 {
+		typ = ipv6.ICMPTypeEchoRequest
+		err = p.conn.IPv6PacketConn().SetHopLimit(ttl)
+	} else {
+		err = p.conn.IPv4PacketConn().SetTTL(ttl)
+	}
+	if err != nil {
+		return
+	}
+	wm := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: p.payload},
+	}
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	deadline := start.Add(p.timeout)
+	if _, err := p.conn.WriteTo(wb, p.dst); err != nil {
+		return
+	}
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return
+	}
+	b := make([]byte, 1500)
+	for {
+		n, peer, err := p.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if p.match(b[:n], seq) {
+			return reply{Success: true, Addr: peer.(*net.IPAddr).IP.String(), Elapsed: time.Since(start)}
+		}
+	}
+}
+
+// match reports whether the icmp message b answers the probe seq.
+func (p *prober) match(b []byte, seq int) bool {
+	proto := 1
+	if p.v6 {
+		proto = 58
+	}
+	m, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return false
+	}
+	var inner []byte
+	switch body := m.Body.(type) {
+	case *icmp.Echo:
+		return (m.Type == ipv4.ICMPTypeEchoReply || m.Type == ipv6.ICMPTypeEchoReply) && body.ID == p.id && body.Seq == seq
+	case *icmp.TimeExceeded:
+		inner = body.Data
+	case *icmp.DstUnreach:
+		inner = body.Data
+	default:
+		return false
+	}
+	// the error quotes our packet: its ip header, then the echo request
+	off := ipv6.HeaderLen
+	if !p.v6 {
+		if len(inner) < ipv4.HeaderLen {
+			return false
+		}
+		off = int(inner[0]&0x0f) * 4
+	}
+	if len(inner) < off+8 {
+		return false
+	}
+	echo := inner[off:]
+	return int(binary.BigEndian.Uint16(echo[4:])) == p.id && int(binary.BigEndian.Uint16(echo[6:])) == seq
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"neko-exporter/ping"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type pingQuery struct {
+	host     string
+	protocol string
+	port     int
+	count    int
+	interval int
+	timeout  int
+}
+
+// Bounds of ping runs, the interval and timeout are in milliseconds and a
+// run lasts at most PING_MAX_TIME seconds.
+const (
+	PING_MAX_COUNT    = 1000
+	PING_MIN_INTERVAL = 100
+	PING_MAX_INTERVAL = 60000
+	PING_MAX_TIMEOUT  = 10000
+	PING_MAX_TIME     = 300
+)
+
+func parsePing(get func(string) string) (pingQuery, error) {
+	q := pingQuery{
+		host:     get("host"),
+		protocol: get("protocol"),
+	}
+	if q.protocol != "" && q.protocol != "icmp" && q.protocol != "tcp" {
+		return q, fmt.Errorf("unknown protocol %q", q.protocol)
+	}
+	q.port, _ = strconv.Atoi(get("port"))
+	if q.port < 0 || q.port > 65535 {
+		return q, fmt.Errorf("invalid port %d", q.port)
+	}
+	q.count, _ = strconv.Atoi(get("count"))
+	if q.count == 0 {
+		q.count = 10
+	}
+	if q.count < 1 || q.count > PING_MAX_COUNT {
+		return q, fmt.Errorf("count must be between 1 and %d", PING_MAX_COUNT)
+	}
+	q.interval, _ = strconv.Atoi(get("interval"))
+	if q.interval == 0 {
+		q.interval = 1000
+	}
+	if q.interval < PING_MIN_INTERVAL || q.interval > PING_MAX_INTERVAL {
+		return q, fmt.Errorf("interval must be between %d and %d", PING_MIN_INTERVAL, PING_MAX_INTERVAL)
+	}
+	q.timeout, _ = strconv.Atoi(get("timeout"))
+	if q.timeout == 0 {
+		q.timeout = 1000
+	}
+	if q.timeout < 10 || q.timeout > PING_MAX_TIMEOUT {
+		return q, fmt.Errorf("timeout must be between 10 and %d", PING_MAX_TIMEOUT)
+	}
+	if q.count*q.interval > PING_MAX_TIME*1000 {
+		return q, fmt.Errorf("count times interval must not exceed %ds", PING_MAX_TIME)
+	}
+	return q, nil
+}
+
+func Ping(c *gin.Context) {
+	q, err := parsePing(c.Query)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
+	}
+	if q.host = resolveTarget(c, "ip", q.host); q.host == "" {
+		return
+	}
+	release := acquire(c, "ping")
+	if release == nil {
+		return
+	}
+	defer release()
+	res, err := ping.Ping(c.Request.Context(), q.host, q.port, q.count, q.interval, q.timeout, q.protocol, false)
+	if err == nil {
+		resp(c, true, res, 200)
+	} else {
+		resp(c, false, err.Error(), 500)
+	}
+}
+
+func PingWs(c *gin.Context) {
+	q, err := parsePing(c.Query)
+	if err != nil {
+		resp(c, false, err.Error(), 400)
+		return
+	}
+	if q.host = resolveTarget(c, "ip", q.host); q.host == "" {
+		return
+	}
+	ws, err := upgrade(c)
+	if err != nil {
+		return
+	}
+	defer ws.release()
+	ctx, cancel := wsContext(ws)
+	defer cancel()
+	release := acquireWs(ctx, ws, "ping")
+	if release == nil {
+		return
+	}
+	defer release()
+	ping.PingWs(ctx, q.host, q.port, q.count, q.interval, q.timeout, q.protocol, ws)
+}
@@ -1,34 +1,48 @@
 package ping
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/go-ping/ping"
-	"github.com/gorilla/websocket"
 )
 
-func ICMPing(ip string, count int, interval, timeout time.Duration, verbose bool) (Result, error) {
+// stopOnDone stops pinger when ctx is done, the returned function must be
+// called once the pinger finished.
+func stopOnDone(ctx context.Context, pinger *ping.Pinger) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pinger.Stop()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+func ICMPing(ctx context.Context, ip string, count int, interval, timeout time.Duration, verbose bool) (Result, error) {
 	pinger, err := ping.NewPinger(ip)
 	if err != nil {
-		return Result{IP: ip, Err: err}, err
+		return Result{IP: ip, Err: err.Error()}, err
 	}
 	if count > 0 {
 		pinger.Count = count
 	}
 	pinger.Interval = interval
 	pinger.Timeout = timeout
+	// unprivileged udp pings depend on net.ipv4.ping_group_range, raw
+	// sockets work whenever we run as root like mtr requires anyway
+	pinger.SetPrivileged(os.Geteuid() == 0)
 	if verbose {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			for range c {
-				pinger.Stop()
-			}
-		}()
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
 	}
+	defer stopOnDone(ctx, pinger)()
 	packets := make([]packet, 0, count)
 	pinger.OnRecv = func(p *ping.Packet) {
 		packets = append(packets, packet{
@@ -55,9 +69,13 @@ func ICMPing(ip string, count int, interval, timeout time.Duration, verbose bool
 		}
 	}
 	if err := pinger.Run(); err != nil {
-		return Result{IP: ip, Err: err}, err
+		return Result{IP: ip, Err: err.Error()}, err
 	}
 	s := pinger.Statistics()
+	errs := ""
+	if ctx.Err() != nil {
+		errs = ctx.Err().Error()
+	}
 	return Result{
 		IP:          ip,
 		Sent:        s.PacketsSent,
@@ -68,19 +86,21 @@ func ICMPing(ip string, count int, interval, timeout time.Duration, verbose bool
 		Max:         float64(s.MaxRtt.Microseconds()) / 1000,
 		Stdev:       float64(s.StdDevRtt.Microseconds()) / 1000,
 		RecvPackets: packets,
+		Err:         errs,
 	}, nil
 }
 
-func ICMPingWs(ip string, count int, interval, timeout time.Duration, ws *websocket.Conn) {
+func ICMPingWs(ctx context.Context, ip string, count int, interval, timeout time.Duration, ws Conn) {
 	defer ws.Close()
 	pinger, err := ping.NewPinger(ip)
 	if err != nil {
-		ws.WriteJSON(Result{IP: ip, Err: err})
+		ws.WriteJSON(Result{IP: ip, Err: err.Error()})
 		return
 	}
 	pinger.Count = count
 	pinger.Interval = interval
 	pinger.Timeout = timeout
+	pinger.SetPrivileged(os.Geteuid() == 0)
 	packets := make([]packet, 0, count)
 	pinger.OnRecv = func(p *ping.Packet) {
 		packet := packet{
@@ -110,6 +130,10 @@ func ICMPingWs(ip string, count int, interval, timeout time.Duration, ws *websoc
 	}
 
 	pinger.OnFinish = func(stats *ping.Statistics) {
+		errs := ""
+		if ctx.Err() != nil {
+			errs = ctx.Err().Error()
+		}
 		ws.WriteJSON(Result{
 			IP:          ip,
 			Sent:        stats.PacketsSent,
@@ -120,6 +144,7 @@ func ICMPingWs(ip string, count int, interval, timeout time.Duration, ws *websoc
 			Max:         float64(stats.MaxRtt.Microseconds()) / 1000,
 			Stdev:       float64(stats.StdDevRtt.Microseconds()) / 1000,
 			RecvPackets: packets,
+			Err:         errs,
 		})
 
 		// fmt.Printf("\n--- %s ping statistics ---\n", stats.Addr)
@@ -128,8 +153,9 @@ func ICMPingWs(ip string, count int, interval, timeout time.Duration, ws *websoc
 		// fmt.Printf("round-trip min/avg/max/stdev = %v/%v/%v/%v\n",
 		// 	stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt)
 	}
+	defer stopOnDone(ctx, pinger)()
 	if err := pinger.Run(); err != nil {
-		ws.WriteJSON(Result{IP: ip, Err: err})
+		ws.WriteJSON(Result{IP: ip, Err: err.Error()})
 		return
 	}
 }
@@ -1,14 +1,21 @@
 package ping
 
 import (
+	"context"
 	"net"
 	"time"
 )
 
+// Conn receives the streamed results, usually a *websocket.Conn.
+type Conn interface {
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
 type packet struct {
 	Rtt float64
 	Seq int
-	Err error
+	Err string `json:",omitempty"`
 }
 
 type Result struct {
@@ -19,14 +26,23 @@ type Result struct {
 	LastPacket           packet
 	Avg, Min, Max, Stdev float64
 	RecvPackets          []packet
-	Err                  error
+	Err                  string `json:",omitempty"`
 }
 
-func Ping(host string, port int, count int, interval, timeout int, protocol string, verbose bool) (Result, error) {
-	var ips []string
-	ips, err := net.LookupHost(host)
+type options struct {
+	ip       string
+	port     int
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// resolve applies the defaults, timeout is per probe for tcp and for the
+// whole run for icmp.
+func resolve(ctx context.Context, host string, port int, count int, interval, timeout int, protocol string) (o options, err error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
 	if err != nil {
-		return Result{}, err
+		return
 	}
 	if port == 0 {
 		port = 22
@@ -37,15 +53,46 @@ func Ping(host string, port int, count int, interval, timeout int, protocol stri
 	if interval == 0 {
 		interval = 1000
 	}
-	Interval := time.Duration(interval) * time.Millisecond
 	if timeout == 0 {
 		timeout = 1000
 	}
-	Timeout := time.Duration(timeout+count*interval) * time.Millisecond
+	o = options{
+		ip:       ips[0],
+		port:     port,
+		count:    count,
+		interval: time.Duration(interval) * time.Millisecond,
+		timeout:  time.Duration(timeout) * time.Millisecond,
+	}
+	if protocol != "tcp" {
+		o.timeout = time.Duration(timeout+count*interval) * time.Millisecond
+	}
+	return
+}
+
+func Ping(ctx context.Context, host string, port int, count int, interval, timeout int, protocol string, verbose bool) (Result, error) {
+	o, err := resolve(ctx, host, port, count, interval, timeout, protocol)
+	if err != nil {
+		return Result{Err: err.Error()}, err
+	}
+	switch protocol {
+	case "tcp":
+		return TCPing(ctx, o.ip, o.port, o.count, o.interval, o.timeout, verbose)
+	default:
+		return ICMPing(ctx, o.ip, o.count, o.interval, o.timeout, verbose)
+	}
+}
+
+func PingWs(ctx context.Context, host string, port int, count int, interval, timeout int, protocol string, ws Conn) {
+	o, err := resolve(ctx, host, port, count, interval, timeout, protocol)
+	if err != nil {
+		ws.WriteJSON(Result{Err: err.Error()})
+		ws.Close()
+		return
+	}
 	switch protocol {
 	case "tcp":
-		return TCPing(ips[0], port, count, Interval, Timeout, verbose)
+		TCPingWs(ctx, o.ip, o.port, o.count, o.interval, o.timeout, ws)
 	default:
-		return ICMPing(ips[0], count, Interval, Timeout, verbose)
+		ICMPingWs(ctx, o.ip, o.count, o.interval, o.timeout, ws)
 	}
 }
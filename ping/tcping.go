@@ -7,96 +7,115 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 )
 
-func TCPing(ip string, port int, count int, interval, timeout time.Duration, verbose bool) (Result, error) {
-	taddr := &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+// tcping connects to ip:port count times, one connection every interval,
+// and calls onRecv with the running statistic after each probe. It returns
+// early when ctx is done.
+func tcping(ctx context.Context, ip string, port int, count int, interval, timeout time.Duration, onRecv func(Result)) Result {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
 	packets := make([]packet, 0, count)
-	sum, sd, min, max := float64(0), float64(0), float64(100000), float64(0)
-	recv, sent := 0, 0
 	recvc := make(chan packet, count)
-
-	t := time.NewTicker(interval)
-	defer t.Stop()
-	if verbose {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+	sent := 0
+	probe := func(seq int) {
+		sent++
 		go func() {
-			for range c {
-				t.Stop()
-				close(recvc)
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			d := net.Dialer{}
+			st := time.Now()
+			rc, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				recvc <- packet{Rtt: 0, Seq: seq, Err: err.Error()}
+				return
 			}
+			rc.Close()
+			recvc <- packet{Rtt: float64(time.Since(st).Microseconds()) / 1000, Seq: seq}
 		}()
 	}
-	go func() {
-		for i := 0; i < count; i++ {
-			go func(seq int) {
-				sent++
-				ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(timeout))
-				defer cancel()
-				st := time.Now()
-				rc, err := net.DialTCPContext(ctx, "tcp", nil, taddr)
-				if err != nil {
-					recvc <- packet{Rtt: 0, Seq: seq, Err: err}
-					return
-				}
-				defer rc.Close()
-				recvc <- packet{Rtt: float64(time.Since(st).Microseconds()) / 1000, Seq: seq}
-			}(i)
-			if _, ok := <-t.C; !ok {
-				break
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	if count > 0 {
+		probe(0)
+	}
+	for len(packets) < count {
+		select {
+		case <-ctx.Done():
+			res := summarize(ip, sent, packets)
+			res.Err = ctx.Err().Error()
+			return res
+		case <-t.C:
+			if sent < count {
+				probe(sent)
 			}
-		}
-	}()
-	for i := 0; i < count; i++ {
-		p, ok := <-recvc
-		if !ok {
-			break
-		}
-		packets = append(packets, p)
-		if p.Err != nil {
-			if verbose {
-				fmt.Println("TCPing to", ip, "Err:", p.Err)
+		case p := <-recvc:
+			packets = append(packets, p)
+			if onRecv != nil {
+				res := summarize(ip, sent, packets)
+				res.LastPacket = p
+				onRecv(res)
 			}
-			continue
 		}
-		recv++
-		sum += p.Rtt
-		if p.Rtt > max {
-			max = p.Rtt
+	}
+	return summarize(ip, sent, packets)
+}
+
+func summarize(ip string, sent int, packets []packet) Result {
+	res := Result{
+		IP:          ip,
+		Sent:        sent,
+		RecvPackets: packets,
+	}
+	var sum, sd float64
+	for _, p := range packets {
+		if p.Err != "" {
+			continue
 		}
-		if p.Rtt < min {
-			min = p.Rtt
+		if res.Recv == 0 || p.Rtt < res.Min {
+			res.Min = p.Rtt
 		}
-		if verbose {
-			fmt.Printf("TCPing from %s: seq=%d time=%.2fms\n", ip, p.Seq, p.Rtt)
+		if p.Rtt > res.Max {
+			res.Max = p.Rtt
 		}
+		res.Recv++
+		sum += p.Rtt
 	}
-	if recv == 0 {
-		return Result{
-			IP:          ip,
-			Sent:        sent,
-			Recv:        recv,
-			LossPercent: float64(100),
-		}, nil
+	if sent > 0 {
+		res.LossPercent = float64(sent-res.Recv) / float64(sent) * 100
 	}
-	avg := sum / float64(recv)
+	if res.Recv == 0 {
+		return res
+	}
+	res.Avg = sum / float64(res.Recv)
 	for _, p := range packets {
-		x := p.Rtt - avg
-		sd += x * x
+		if p.Err == "" {
+			x := p.Rtt - res.Avg
+			sd += x * x
+		}
 	}
-	res := Result{
-		IP:          ip,
-		Sent:        sent,
-		Recv:        recv,
-		LossPercent: float64(sent-recv) / float64(count) * 100,
-		Avg:         avg,
-		Min:         min,
-		Max:         max,
-		Stdev:       math.Sqrt(sd / float64(recv)),
-		RecvPackets: packets,
+	res.Stdev = math.Sqrt(sd / float64(res.Recv))
+	return res
+}
+
+func TCPing(ctx context.Context, ip string, port int, count int, interval, timeout time.Duration, verbose bool) (Result, error) {
+	var onRecv func(Result)
+	if verbose {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		onRecv = func(r Result) {
+			p := r.LastPacket
+			if p.Err != "" {
+				fmt.Println("TCPing to", ip, "Err:", p.Err)
+			} else {
+				fmt.Printf("TCPing from %s: seq=%d time=%.2fms\n", ip, p.Seq, p.Rtt)
+			}
+		}
 	}
+	res := tcping(ctx, ip, port, count, interval, timeout, onRecv)
 	if verbose {
 		fmt.Printf("\n--- %s ping statistics ---\n", ip)
 		fmt.Printf("%d packets transmitted, %d packets received, %.2f%% packet loss\n",
@@ -106,3 +125,11 @@ func TCPing(ip string, port int, count int, interval, timeout time.Duration, ver
 	}
 	return res, nil
 }
+
+func TCPingWs(ctx context.Context, ip string, port int, count int, interval, timeout time.Duration, ws Conn) {
+	defer ws.Close()
+	res := tcping(ctx, ip, port, count, interval, timeout, func(r Result) {
+		ws.WriteJSON(r)
+	})
+	ws.WriteJSON(res)
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Reserved are denied unless an Allow cidr covers them: private, loopback,
+// link-local (which includes the cloud metadata address), CGNAT, IETF
+// protocol assignments, benchmarking, unspecified, multicast, their IPv6
+// counterparts, NAT64 (which reaches any IPv4 address) and documentation.
+var Reserved = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var ErrDenied = errors.New("target not allowed")
+
+// Policy decides which targets may be probed. Entries of Allow and Deny are
+// cidrs or path.Match hostname patterns. Deny wins over Allow; when Allow
+// has entries a target must match one of them.
+type Policy struct {
+	allowNets, denyNets   []*net.IPNet
+	allowHosts, denyHosts []string
+	reserved              []*net.IPNet
+}
+
+func New(allow, deny []string, allowReserved bool) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.allowNets, p.allowHosts, err = parse(allow); err != nil {
+		return nil, err
+	}
+	if p.denyNets, p.denyHosts, err = parse(deny); err != nil {
+		return nil, err
+	}
+	if !allowReserved {
+		p.reserved, _, _ = parse(Reserved)
+	}
+	return p, nil
+}
+
+func parse(entries []string) (nets []*net.IPNet, hosts []string, err error) {
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, nil, fmt.Errorf("bad hostname pattern %q", e)
+		}
+		hosts = append(hosts, strings.ToLower(e))
+	}
+	return
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) check(host string, ip net.IP) error {
+	if host != "" && matches(p.denyHosts, host) || contains(p.denyNets, ip) {
+		return ErrDenied
+	}
+	allowed := host != "" && matches(p.allowHosts, host) || contains(p.allowNets, ip)
+	if contains(p.reserved, ip) && !contains(p.allowNets, ip) {
+		return ErrDenied
+	}
+	if len(p.allowNets)+len(p.allowHosts) > 0 && !allowed {
+		return ErrDenied
+	}
+	return nil
+}
+
+// Resolve looks up host on network ("ip", "ip4" or "ip6") and returns the
+// first address the policy allows. Probes must use the returned address
+// instead of resolving host again, so a rebinding DNS answer can't swap in
+// a denied address after the check.
+func (p *Policy) Resolve(ctx context.Context, network, host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return "", errors.New("no target host")
+	}
+	if matches(p.denyHosts, host) {
+		return "", ErrDenied
+	}
+	var ips []net.IP
+	name := host
+	if ip := net.ParseIP(host); ip != nil {
+		ips, name = []net.IP{ip}, ""
+	} else {
+		var err error
+		if ips, err = net.DefaultResolver.LookupIP(ctx, network, host); err != nil {
+			return "", err
+		}
+	}
+	err := ErrDenied
+	for _, ip := range ips {
+		if network == "ip4" && ip.To4() == nil || network == "ip6" && ip.To4() != nil {
+			continue
+		}
+		if err = p.check(name, ip); err == nil {
+			return ip.String(), nil
+		}
+	}
+	return "", err
+}
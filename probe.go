@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+
+	"neko-exporter/policy"
+	"neko-exporter/sched"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// baseCtx is the parent of every request and probe, cancelling it stops
+	// them all.
+	baseCtx, cancelBase = context.WithCancel(context.Background())
+
+	schedulers = map[string]*sched.Scheduler{}
+	targets    *policy.Policy
+)
+
+func loadTargets() (err error) {
+	targets, err = policy.New(Config.Targets.Allow, Config.Targets.Deny, Config.Targets.AllowReserved)
+	return
+}
+
+// resolveTarget resolves host on network and applies the target policy. On
+// failure the request is answered and "" returned.
+func resolveTarget(c *gin.Context, network, host string) string {
+	return resolvePreferred(c, host, network)
+}
+
+// resolvePreferred is resolveTarget trying networks in order, the first
+// error is answered when host has no allowed address on any.
+func resolvePreferred(c *gin.Context, host string, networks ...string) string {
+	var first error
+	for _, network := range networks {
+		ip, err := targets.Resolve(c.Request.Context(), network, host)
+		if err == nil {
+			return ip
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == policy.ErrDenied {
+		resp(c, false, first.Error(), 403)
+	} else {
+		resp(c, false, first.Error(), 400)
+	}
+	return ""
+}
+
+func loadSchedulers() {
+	for name, l := range map[string]LIMIT{
+		"ping":   withDefault(Config.Probes.Ping, LIMIT{Concurrency: 8, Queue: 32}),
+		"mtr":    withDefault(Config.Probes.Mtr, LIMIT{Concurrency: 4, Queue: 16}),
+		"iperf3": withDefault(Config.Probes.Iperf3, LIMIT{Concurrency: 1, Queue: 4}),
+	} {
+		schedulers[name] = sched.New(l.Concurrency, l.Queue)
+	}
+}
+
+func withDefault(l, def LIMIT) LIMIT {
+	if l.Concurrency == 0 {
+		l.Concurrency = def.Concurrency
+	}
+	switch {
+	case l.Queue == 0:
+		l.Queue = def.Queue
+	case l.Queue < 0:
+		l.Queue = 0
+	}
+	return l
+}
+
+// acquire waits for a probe slot for a plain http request. A full queue is
+// answered with 503 and nil is returned.
+func acquire(c *gin.Context, probe string) func() {
+	release, err := schedulers[probe].Acquire(c.Request.Context(), nil)
+	if err != nil {
+		resp(c, false, gin.H{"error": err.Error(), "queue": schedulers[probe].State()}, 503)
+		return nil
+	}
+	return release
+}
+
+// acquireWs waits for a probe slot for a websocket client, reporting the
+// queue position while waiting. It gives up when ctx, usually from
+// wsContext, is done. On failure ws is closed and nil returned.
+func acquireWs(ctx context.Context, ws *wsConn, probe string) func() {
+	release, err := schedulers[probe].Acquire(ctx, func(s sched.State) {
+		ws.WriteJSON(gin.H{"Queue": s})
+	})
+	if err != nil {
+		if err == sched.ErrQueueFull {
+			ws.WriteJSON(gin.H{"Err": err.Error(), "Queue": schedulers[probe].State()})
+		}
+		ws.Close()
+		return nil
+	}
+	return release
+}
+
+// wsContext returns a context cancelled when the websocket client
+// disconnects. It reads and discards every message, so the caller must not
+// read from ws itself.
+func wsContext(ws *wsConn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(baseCtx)
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,147 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// Report is a collected snapshot, Time is in unix seconds.
+type Report struct {
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type Pusher struct {
+	Url       string
+	Key       string
+	Interval  time.Duration
+	Jitter    time.Duration
+	Timeout   time.Duration
+	SpoolSize int
+	Collect   func() (interface{}, error)
+
+	client  *http.Client
+	rand    *rand.Rand
+	spool   []Report
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// Run collects a report every Interval (plus up to Jitter) and posts the
+// spooled reports to Url, oldest first. While the server is unreachable
+// reports are kept in a bounded spool and retried with exponential backoff.
+// When ctx is done the spool is flushed a last time and Run returns.
+func (p *Pusher) Run(ctx context.Context) {
+	if p.Interval <= 0 {
+		p.Interval = 10 * time.Second
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = 10 * time.Second
+	}
+	if p.SpoolSize <= 0 {
+		p.SpoolSize = 360
+	}
+	p.client = &http.Client{Timeout: p.Timeout}
+	p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// spread the first report over a whole interval so nodes started together
+	// don't report together
+	wait := time.Duration(p.rand.Int63n(int64(p.Interval)))
+	for {
+		select {
+		case <-ctx.Done():
+			p.flush()
+			return
+		case <-time.After(wait):
+		}
+		p.collect()
+		if !time.Now().Before(p.retryAt) {
+			p.flush()
+		}
+		wait = p.Interval + p.jitter()
+	}
+}
+
+func (p *Pusher) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(p.rand.Int63n(int64(p.Jitter)))
+}
+
+func (p *Pusher) collect() {
+	data, err := p.Collect()
+	if err != nil {
+		log.Println("push: collect:", err)
+		return
+	}
+	if len(p.spool) >= p.SpoolSize {
+		p.spool = p.spool[len(p.spool)-p.SpoolSize+1:]
+	}
+	p.spool = append(p.spool, Report{Time: time.Now().Unix(), Data: data})
+}
+
+func (p *Pusher) flush() {
+	for len(p.spool) > 0 {
+		if err := p.send(p.spool[0]); err != nil {
+			if p.backoff == 0 {
+				log.Println("push:", err)
+			}
+			p.fail()
+			return
+		}
+		p.spool[0] = Report{}
+		p.spool = p.spool[1:]
+	}
+	if p.backoff != 0 {
+		log.Println("push: server reachable again")
+	}
+	p.backoff = 0
+	p.retryAt = time.Time{}
+}
+
+// fail doubles the backoff and schedules the next attempt at a random point
+// within it, so a recovering server isn't hit by every node at once.
+func (p *Pusher) fail() {
+	if p.backoff == 0 {
+		p.backoff = minBackoff
+	} else if p.backoff *= 2; p.backoff > maxBackoff {
+		p.backoff = maxBackoff
+	}
+	p.retryAt = time.Now().Add(p.backoff/2 + time.Duration(p.rand.Int63n(int64(p.backoff/2)+1)))
+}
+
+func (p *Pusher) send(r Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("key", p.Key)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server responded %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"neko-exporter/metrics"
+	"neko-exporter/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+type endpointLimit struct {
+	key, ip                 *ratelimit.Limiter
+	rejectedKey, rejectedIp uint64
+}
+
+var limits map[string]*endpointLimit
+
+func loadRateLimits() {
+	limits = map[string]*endpointLimit{}
+	for endpoint, l := range Config.RateLimits {
+		e := &endpointLimit{}
+		if l.Key.Rate > 0 {
+			e.key = ratelimit.New(l.Key.Rate/60, l.Key.Burst)
+		}
+		if l.Ip.Rate > 0 {
+			e.ip = ratelimit.New(l.Ip.Rate/60, l.Ip.Burst)
+		}
+		limits[endpoint] = e
+	}
+}
+
+// rateLimit answers 429 with Retry-After when the key or the source address
+// exhausted its bucket for the endpoint. It runs after checkKey.
+func rateLimit(c *gin.Context) {
+	if allow(c, c.FullPath()) {
+		c.Next()
+	}
+}
+
+// allow takes a token of the key and the source address from the buckets of
+// endpoint, answering 429 when one is exhausted.
+func allow(c *gin.Context, endpoint string) bool {
+	e, ok := limits[endpoint]
+	if !ok {
+		return true
+	}
+	if e.key != nil {
+		if ok, retry := e.key.Allow(c.MustGet("key").(*apiKey).name); !ok {
+			atomic.AddUint64(&e.rejectedKey, 1)
+			tooMany(c, retry.Seconds())
+			return false
+		}
+	}
+	if e.ip != nil {
+		if ok, retry := e.ip.Allow(c.ClientIP()); !ok {
+			atomic.AddUint64(&e.rejectedIp, 1)
+			tooMany(c, retry.Seconds())
+			return false
+		}
+	}
+	return true
+}
+
+func tooMany(c *gin.Context, retry float64) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry))))
+	resp(c, false, "Too many requests", 429)
+	c.Abort()
+}
+
+func sortedEndpoints() []string {
+	res := make([]string, 0, len(limits))
+	for endpoint := range limits {
+		res = append(res, endpoint)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// rejectedCounters feeds the stat snapshots.
+func rejectedCounters() map[string]uint64 {
+	res := map[string]uint64{}
+	for endpoint, e := range limits {
+		res["ratelimit_rejected:"+endpoint+":key"] = atomic.LoadUint64(&e.rejectedKey)
+		res["ratelimit_rejected:"+endpoint+":ip"] = atomic.LoadUint64(&e.rejectedIp)
+	}
+	return res
+}
+
+func writeRateLimitMetrics(w *metrics.Writer) {
+	w.Family("neko_ratelimit_rejected_total", "Requests rejected by the rate limits.", metrics.Counter)
+	for _, endpoint := range sortedEndpoints() {
+		e := limits[endpoint]
+		w.Sample("neko_ratelimit_rejected_total", metrics.Labels{"endpoint": endpoint, "by": "key"}, float64(atomic.LoadUint64(&e.rejectedKey)))
+		w.Sample("neko_ratelimit_rejected_total", metrics.Labels{"endpoint": endpoint, "by": "ip"}, float64(atomic.LoadUint64(&e.rejectedIp)))
+	}
+}
@@ -0,0 +1,135 @@
+package sched
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("probe queue full")
+
+// Scheduler runs at most Limit jobs at once and lets up to Queue more wait
+// for a slot in arrival order.
+type Scheduler struct {
+	Limit int
+	Queue int
+
+	mu      sync.Mutex
+	running int
+	waiting []*waiter
+}
+
+type waiter struct {
+	ready chan struct{}
+	pos   chan int
+}
+
+type State struct {
+	Position int // 1 is next in line, 0 is running
+	Running  int
+	Waiting  int
+}
+
+func New(limit, queue int) *Scheduler {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &Scheduler{Limit: limit, Queue: queue}
+}
+
+// Acquire waits for a slot and returns the function releasing it. While
+// queued onWait, if not nil, is called with every change of position.
+func (s *Scheduler) Acquire(ctx context.Context, onWait func(State)) (func(), error) {
+	s.mu.Lock()
+	if s.running < s.Limit && len(s.waiting) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.releaser(), nil
+	}
+	if len(s.waiting) >= s.Queue {
+		s.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}), pos: make(chan int, 1)}
+	s.waiting = append(s.waiting, w)
+	w.pos <- len(s.waiting)
+	s.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ready:
+			return s.releaser(), nil
+		case pos := <-w.pos:
+			if onWait != nil {
+				onWait(s.state(pos))
+			}
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			select {
+			case <-w.ready:
+				// got the slot while giving up, hand it on
+				s.running--
+				s.dispatch()
+			default:
+				s.remove(w)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Scheduler) state(pos int) State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return State{Position: pos, Running: s.running, Waiting: len(s.waiting)}
+}
+
+// State reports the current load, Position is always 0.
+func (s *Scheduler) State() State {
+	return s.state(0)
+}
+
+func (s *Scheduler) releaser() func() {
+	var once sync.Once
+	return func() { once.Do(s.release) }
+}
+
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch starts waiters while there are free slots, s.mu must be held.
+func (s *Scheduler) dispatch() {
+	for s.running < s.Limit && len(s.waiting) > 0 {
+		w := s.waiting[0]
+		s.waiting = s.waiting[1:]
+		s.running++
+		close(w.ready)
+		s.renumber()
+	}
+}
+
+func (s *Scheduler) remove(w *waiter) {
+	for i, x := range s.waiting {
+		if x == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			s.renumber()
+			return
+		}
+	}
+}
+
+// renumber tells every waiter its new position, keeping only the latest.
+func (s *Scheduler) renumber() {
+	for i, w := range s.waiting {
+		select {
+		case <-w.pos:
+		default:
+		}
+		w.pos <- i + 1
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"neko-exporter/iperf3"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// closeWait bounds writing the close frame of a websocket.
+const closeWait = time.Second
+
+var errShutdown = errors.New("server is shutting down")
+
+// pushing is the push loop next to the api, shutdown waits for its last
+// flush.
+var pushing sync.WaitGroup
+
+// sockets are the websockets being served, shutdown waits for their
+// handlers and closes what is left at the deadline.
+var sockets = struct {
+	sync.Mutex
+	conns  map[*wsConn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}{conns: map[*wsConn]struct{}{}}
+
+// wsConn is a websocket tracked in sockets. Close sends a close frame
+// before closing the connection, so clients can tell a finished stream from
+// a dropped one.
+type wsConn struct {
+	*websocket.Conn
+	once sync.Once
+}
+
+// upgrade upgrades the request to a websocket, the handler must call
+// release when it is done with it. Once shutdown began it fails with 503.
+func upgrade(c *gin.Context) (*wsConn, error) {
+	sockets.Lock()
+	defer sockets.Unlock()
+	if sockets.closed {
+		resp(c, false, errShutdown.Error(), 503)
+		return nil, errShutdown
+	}
+	conn, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws := &wsConn{Conn: conn}
+	sockets.conns[ws] = struct{}{}
+	sockets.wg.Add(1)
+	return ws, nil
+}
+
+func (ws *wsConn) release() {
+	ws.Close()
+	sockets.Lock()
+	delete(sockets.conns, ws)
+	sockets.Unlock()
+	sockets.wg.Done()
+}
+
+// Close says going away instead of normal closure during shutdown.
+func (ws *wsConn) Close() (err error) {
+	ws.once.Do(func() {
+		code := websocket.CloseNormalClosure
+		if baseCtx.Err() != nil {
+			code = websocket.CloseGoingAway
+		}
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(closeWait))
+		err = ws.Conn.Close()
+	})
+	return
+}
+
+// serve runs srv until SIGINT or SIGTERM and then shuts it down. A second
+// signal kills the process right away.
+func serve(srv *http.Server, listen func() error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listen()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case s := <-sig:
+		signal.Stop(sig)
+		log.Println("shutting down on", s)
+	}
+	timeout := time.Duration(Config.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	shutdown(srv, timeout)
+}
+
+// stopOnSignal stops the push loop on SIGINT or SIGTERM when no api is
+// served. A second signal kills the process right away.
+func stopOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	signal.Stop(sig)
+	log.Println("shutting down on", s)
+	cancelBase()
+}
+
+// shutdown stops accepting connections and cancels every probe and job,
+// which ends their websockets with a going away frame. It waits up to
+// timeout for the handlers and the last push before closing what is left,
+// then stops the iperf3 servers.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	sockets.Lock()
+	sockets.closed = true
+	sockets.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		srv.Shutdown(ctx)
+	}()
+	cancelBase()
+	go func() {
+		defer wg.Done()
+		sockets.wg.Wait()
+	}()
+	go func() {
+		defer wg.Done()
+		jobManager.Wait()
+	}()
+	go func() {
+		defer wg.Done()
+		pushing.Wait()
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("shutdown deadline exceeded, closing remaining connections")
+		srv.Close()
+		sockets.Lock()
+		for ws := range sockets.conns {
+			ws.Close()
+		}
+		sockets.Unlock()
+	}
+	iperf3.DefaultServers.Shutdown()
+}
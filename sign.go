@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A signed request carries these headers, or for websockets where browsers
+// can't set headers, the query parameters of the same name in lower case
+// without the prefix (key_id, timestamp, nonce, signature). The signature is
+// the hex HMAC-SHA256 of the key over
+//
+//	METHOD \n PATH \n QUERY \n TIMESTAMP \n NONCE \n BODY
+//
+// where QUERY is the url encoded query sorted by name without signature and
+// BODY the hex SHA-256 of the request body, that of no bytes when empty.
+const (
+	HEADER_KEY_ID    = "X-Neko-Key-Id"
+	HEADER_TIMESTAMP = "X-Neko-Timestamp"
+	HEADER_NONCE     = "X-Neko-Nonce"
+	HEADER_SIGNATURE = "X-Neko-Signature"
+)
+
+var (
+	errStale    = errors.New("request timestamp outside the allowed window")
+	errReplayed = errors.New("request nonce already used")
+	errBadSign  = errors.New("request signature incorrect")
+)
+
+type signature struct {
+	keyID     string
+	timestamp int64
+	nonce     string
+	sig       []byte
+}
+
+func param(r *http.Request, header, query string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(query)
+}
+
+// parseSignature returns nil for requests that aren't signed.
+func parseSignature(r *http.Request) (*signature, error) {
+	sig := param(r, HEADER_SIGNATURE, "signature")
+	if sig == "" {
+		return nil, nil
+	}
+	s := &signature{
+		keyID: param(r, HEADER_KEY_ID, "key_id"),
+		nonce: param(r, HEADER_NONCE, "nonce"),
+	}
+	var err error
+	if s.timestamp, err = strconv.ParseInt(param(r, HEADER_TIMESTAMP, "timestamp"), 10, 64); err != nil {
+		return nil, errStale
+	}
+	if s.sig, err = hex.DecodeString(sig); err != nil || s.nonce == "" {
+		return nil, errBadSign
+	}
+	return s, nil
+}
+
+// maxSignedBody bounds the bodies read to check their signature.
+const maxSignedBody = 1 << 20
+
+// bodyHash returns the hex SHA-256 of the body of r and puts the body back
+// for the handlers.
+func bodyHash(r *http.Request) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxSignedBody {
+		return "", errors.New("request body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func canonical(r *http.Request, timestamp int64, nonce, body string) string {
+	q := r.URL.Query()
+	for _, p := range []string{"key_id", "timestamp", "nonce", "signature"} {
+		q.Del(p)
+	}
+	return strings.Join([]string{
+		r.Method,
+		r.URL.Path,
+		q.Encode(),
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		body,
+	}, "\n")
+}
+
+func sign(secret string, msg string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func (s *signature) verify(r *http.Request, secret string) bool {
+	body, err := bodyHash(r)
+	return err == nil && hmac.Equal(s.sig, sign(secret, canonical(r, s.timestamp, s.nonce, body)))
+}
+
+// nonceCache remembers the nonces seen within the window; older requests are
+// rejected by their timestamp so the cache never grows past one window.
+type nonceCache struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func (n *nonceCache) check(keyID, nonce string, timestamp int64) error {
+	now := time.Now()
+	ts := time.Unix(timestamp, 0)
+	if ts.Before(now.Add(-n.window)) || ts.After(now.Add(n.window)) {
+		return errStale
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.pruned) > n.window {
+		for k, exp := range n.seen {
+			if now.After(exp) {
+				delete(n.seen, k)
+			}
+		}
+		n.pruned = now
+	}
+	id := keyID + "\n" + nonce
+	if exp, ok := n.seen[id]; ok && now.Before(exp) {
+		return errReplayed
+	}
+	// the nonce stays valid as long as its timestamp does
+	n.seen[id] = ts.Add(n.window)
+	return nil
+}
@@ -0,0 +1,203 @@
+package stat
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// DiskConfig selects the filesystems and block devices reported. Patterns
+// are path.Match patterns; an empty Mountpoints reports every mountpoint
+// whose fstype isn't ignored.
+type DiskConfig struct {
+	Mountpoints   []string
+	IgnoreFstypes []string
+	IgnoreDevices []string
+}
+
+var Disks = DiskConfig{
+	IgnoreFstypes: []string{
+		"autofs", "binfmt_misc", "bpf", "cgroup", "cgroup2", "configfs",
+		"debugfs", "devpts", "devtmpfs", "efivarfs", "fuse.lxcfs", "fusectl",
+		"hugetlbfs", "mqueue", "nsfs", "overlay", "proc", "pstore", "ramfs",
+		"rpc_pipefs", "securityfs", "squashfs", "sysfs", "tmpfs", "tracefs",
+		// remote filesystems, whose statfs blocks while the server is away
+		"9p", "afs", "ceph", "cifs", "fuse.sshfs", "glusterfs", "lustre",
+		"ncpfs", "nfs", "nfs4", "smb3", "smbfs",
+	},
+	IgnoreDevices: []string{"loop*", "ram*", "zram*"},
+}
+
+type Disk struct {
+	Mounts  []Mount               `json:"mounts"`
+	Devices map[string]DiskDevice `json:"devices"`
+}
+
+type Mount struct {
+	Mountpoint        string  `json:"mountpoint"`
+	Device            string  `json:"device"`
+	Fstype            string  `json:"fstype"`
+	Total             uint64  `json:"total"`
+	Used              uint64  `json:"used"`
+	Free              uint64  `json:"free"`
+	UsedPercent       float64 `json:"used_percent"`
+	InodesTotal       uint64  `json:"inodes_total"`
+	InodesUsed        uint64  `json:"inodes_used"`
+	InodesFree        uint64  `json:"inodes_free"`
+	InodesUsedPercent float64 `json:"inodes_used_percent"`
+}
+
+// DiskDevice rates are per second, Util is the fraction of time the device
+// was busy (0-1) and Await the mean time an IO took in milliseconds.
+type DiskDevice struct {
+	ReadBytes  float64 `json:"read_bytes"`
+	WriteBytes float64 `json:"write_bytes"`
+	ReadOps    float64 `json:"read_ops"`
+	WriteOps   float64 `json:"write_ops"`
+	Util       float64 `json:"util"`
+	Await      float64 `json:"await"`
+}
+
+func (c DiskConfig) mount(p disk.PartitionStat) bool {
+	if contains(c.IgnoreFstypes, p.Fstype) {
+		return false
+	}
+	return len(c.Mountpoints) == 0 || match(c.Mountpoints, p.Mountpoint)
+}
+
+func (c DiskConfig) device(name string) bool {
+	return !match(c.IgnoreDevices, name)
+}
+
+func readDiskIO() (map[string]disk.IOCountersStat, error) {
+	io, err := disk.IOCounters()
+	if err != nil {
+		return nil, err
+	}
+	for name := range io {
+		if !Disks.device(name) {
+			delete(io, name)
+		}
+	}
+	return io, nil
+}
+
+// MountRefresh is how often the usage of the filesystems is read, it
+// changes slower than the rates. A statfs taking longer than statfsTimeout
+// is given up and its mount skipped until the call returns.
+var MountRefresh = 30 * time.Second
+
+const statfsTimeout = time.Second
+
+var (
+	errStatfsTimeout = errors.New("statfs timed out")
+
+	mounts struct {
+		sync.Mutex
+		at  time.Time
+		res []Mount
+	}
+	// statfsBusy holds the mountpoints whose statfs hasn't returned
+	statfsBusy sync.Map
+)
+
+// statfs runs statfs on mountpoint for at most statfsTimeout.
+func statfs(mountpoint string) (*disk.UsageStat, error) {
+	if _, busy := statfsBusy.LoadOrStore(mountpoint, true); busy {
+		return nil, errStatfsTimeout
+	}
+	type result struct {
+		u   *disk.UsageStat
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		u, err := disk.Usage(mountpoint)
+		statfsBusy.Delete(mountpoint)
+		ch <- result{u, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.u, r.err
+	case <-time.After(statfsTimeout):
+		return nil, errStatfsTimeout
+	}
+}
+
+// readMounts returns the usage of the mounts, read at most every
+// MountRefresh.
+func readMounts() ([]Mount, error) {
+	mounts.Lock()
+	defer mounts.Unlock()
+	if mounts.res != nil && time.Since(mounts.at) < MountRefresh {
+		return mounts.res, nil
+	}
+	res, err := statMounts()
+	if err != nil {
+		return nil, err
+	}
+	mounts.res, mounts.at = res, time.Now()
+	return res, nil
+}
+
+func statMounts() ([]Mount, error) {
+	parts, err := disk.Partitions(true)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Mount, 0)
+	seen := map[string]bool{}
+	for _, p := range parts {
+		if seen[p.Mountpoint] || !Disks.mount(p) {
+			continue
+		}
+		seen[p.Mountpoint] = true
+		u, err := statfs(p.Mountpoint)
+		if err != nil || u.Total == 0 {
+			continue
+		}
+		res = append(res, Mount{
+			Mountpoint:        p.Mountpoint,
+			Device:            p.Device,
+			Fstype:            p.Fstype,
+			Total:             u.Total,
+			Used:              u.Used,
+			Free:              u.Free,
+			UsedPercent:       u.UsedPercent,
+			InodesTotal:       u.InodesTotal,
+			InodesUsed:        u.InodesUsed,
+			InodesFree:        u.InodesFree,
+			InodesUsedPercent: u.InodesUsedPercent,
+		})
+	}
+	return res, nil
+}
+
+func diskDevices(io1, io2 map[string]disk.IOCountersStat, elapsed float64) map[string]DiskDevice {
+	res := make(map[string]DiskDevice, len(io2))
+	for name, d2 := range io2 {
+		d1, ok := io1[name]
+		if !ok || elapsed <= 0 || d2.ReadCount < d1.ReadCount || d2.WriteCount < d1.WriteCount {
+			res[name] = DiskDevice{}
+			continue
+		}
+		ops := float64(d2.ReadCount - d1.ReadCount + d2.WriteCount - d1.WriteCount)
+		dev := DiskDevice{
+			ReadBytes:  float64(d2.ReadBytes-d1.ReadBytes) / elapsed,
+			WriteBytes: float64(d2.WriteBytes-d1.WriteBytes) / elapsed,
+			ReadOps:    float64(d2.ReadCount-d1.ReadCount) / elapsed,
+			WriteOps:   float64(d2.WriteCount-d1.WriteCount) / elapsed,
+			Util:       float64(d2.IoTime-d1.IoTime) / 1000 / elapsed,
+		}
+		if dev.Util > 1 {
+			dev.Util = 1
+		}
+		if ops > 0 {
+			dev.Await = float64(d2.ReadTime-d1.ReadTime+d2.WriteTime-d1.WriteTime) / ops
+		}
+		res[name] = dev
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package stat
+
+import (
+	"fmt"
+	"path"
+)
+
+var Sections = []string{"cpu", "mem", "net", "host", "disk", "load"}
+
+// Filter selects the parts of a Snapshot a subscriber receives. Include and
+// Exclude are path.Match patterns on interface names; when either is set the
+// net totals are computed over the selected interfaces only.
+type Filter struct {
+	Sections []string
+	Include  []string
+	Exclude  []string
+}
+
+// Partial is a Snapshot with the unselected sections left out.
+type Partial struct {
+	SchemaVersion int   `json:"schema_version"`
+	Time          int64 `json:"time"`
+	Interval      int64 `json:"interval"`
+	CPU           *CPU  `json:"cpu,omitempty"`
+	Mem           *Mem  `json:"mem,omitempty"`
+	Net           *Net  `json:"net,omitempty"`
+	Host          *Host `json:"host,omitempty"`
+	Disk          *Disk `json:"disk,omitempty"`
+	Load          *Load `json:"load,omitempty"`
+
+	Counters map[string]uint64 `json:"counters,omitempty"`
+}
+
+func (f Filter) Validate() error {
+	for _, s := range f.Sections {
+		if !contains(Sections, s) {
+			return fmt.Errorf("unknown section %q", s)
+		}
+	}
+	for _, p := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad interface pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func (f Filter) Apply(s Snapshot) Partial {
+	res := Partial{
+		SchemaVersion: s.SchemaVersion,
+		Time:          s.Time,
+		Interval:      s.Interval,
+		Counters:      s.Counters,
+	}
+	if f.has("cpu") {
+		res.CPU = &s.CPU
+	}
+	if f.has("mem") {
+		res.Mem = &s.Mem
+	}
+	if f.has("net") {
+		n := f.net(s.Net)
+		res.Net = &n
+	}
+	if f.has("host") {
+		res.Host = &s.Host
+	}
+	if f.has("disk") {
+		res.Disk = &s.Disk
+	}
+	if f.has("load") {
+		res.Load = &s.Load
+	}
+	return res
+}
+
+func (f Filter) has(section string) bool {
+	return len(f.Sections) == 0 || contains(f.Sections, section)
+}
+
+func (f Filter) net(n Net) Net {
+	if len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return n
+	}
+	res := Net{Devices: map[string]NetDevice{}}
+	for name, dev := range n.Devices {
+		if len(f.Include) > 0 && !match(f.Include, name) || match(f.Exclude, name) {
+			continue
+		}
+		res.Devices[name] = dev
+		res.Delta.In += dev.Delta.In
+		res.Delta.Out += dev.Delta.Out
+		res.Total.In += dev.Total.In
+		res.Total.Out += dev.Total.Out
+	}
+	return res
+}
+
+func match(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
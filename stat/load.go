@@ -0,0 +1,159 @@
+package stat
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/load"
+)
+
+// Load rates are per second.
+type Load struct {
+	Load1           float64 `json:"load1"`
+	Load5           float64 `json:"load5"`
+	Load15          float64 `json:"load15"`
+	ProcsTotal      int     `json:"procs_total"`
+	ProcsRunning    int     `json:"procs_running"`
+	ProcsBlocked    int     `json:"procs_blocked"`
+	ContextSwitches float64 `json:"context_switches"`
+	Interrupts      float64 `json:"interrupts"`
+	Forks           float64 `json:"forks"`
+}
+
+// CPUModes is the fraction of time (0-1) spent in each mode.
+type CPUModes struct {
+	User    float64 `json:"user"`
+	Nice    float64 `json:"nice"`
+	System  float64 `json:"system"`
+	Idle    float64 `json:"idle"`
+	Iowait  float64 `json:"iowait"`
+	Irq     float64 `json:"irq"`
+	Softirq float64 `json:"softirq"`
+	Steal   float64 `json:"steal"`
+}
+
+// kernelCounters are the monotonic counters of /proc/stat.
+type kernelCounters struct {
+	ctxt  uint64
+	intr  uint64
+	forks uint64
+}
+
+func procPath(name string) string {
+	root := os.Getenv("HOST_PROC")
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(root, name)
+}
+
+// readKernelCounters returns zero counters where /proc/stat doesn't exist.
+func readKernelCounters() (k kernelCounters, err error) {
+	f, err := os.Open(procPath("stat"))
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024) // the intr line is long
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "ctxt":
+			k.ctxt = v
+		case "intr":
+			k.intr = v
+		case "processes":
+			k.forks = v
+		}
+	}
+	return k, sc.Err()
+}
+
+func readLoad(k1, k2 kernelCounters, elapsed float64) (Load, error) {
+	var res Load
+	avg, err := load.Avg()
+	if err != nil {
+		return res, err
+	}
+	misc, err := load.Misc()
+	if err != nil {
+		return res, err
+	}
+	res = Load{
+		Load1:        avg.Load1,
+		Load5:        avg.Load5,
+		Load15:       avg.Load15,
+		ProcsTotal:   misc.ProcsTotal,
+		ProcsRunning: misc.ProcsRunning,
+		ProcsBlocked: misc.ProcsBlocked,
+	}
+	if elapsed > 0 {
+		res.ContextSwitches = rate(k1.ctxt, k2.ctxt, elapsed)
+		res.Interrupts = rate(k1.intr, k2.intr, elapsed)
+		res.Forks = rate(k1.forks, k2.forks, elapsed)
+	}
+	return res, nil
+}
+
+func rate(v1, v2 uint64, elapsed float64) float64 {
+	if v2 < v1 {
+		return 0
+	}
+	return float64(v2-v1) / elapsed
+}
+
+func modes(c1, c2 cpu.TimesStat) CPUModes {
+	total := c2.Total() - c1.Total()
+	if total <= 0 {
+		return CPUModes{}
+	}
+	return CPUModes{
+		User:    (c2.User - c1.User) / total,
+		Nice:    (c2.Nice - c1.Nice) / total,
+		System:  (c2.System - c1.System) / total,
+		Idle:    (c2.Idle - c1.Idle) / total,
+		Iowait:  (c2.Iowait - c1.Iowait) / total,
+		Irq:     (c2.Irq - c1.Irq) / total,
+		Softirq: (c2.Softirq - c1.Softirq) / total,
+		Steal:   (c2.Steal - c1.Steal) / total,
+	}
+}
+
+func (m CPUModes) add(x CPUModes, w float64) CPUModes {
+	return CPUModes{
+		User:    m.User + x.User*w,
+		Nice:    m.Nice + x.Nice*w,
+		System:  m.System + x.System*w,
+		Idle:    m.Idle + x.Idle*w,
+		Iowait:  m.Iowait + x.Iowait*w,
+		Irq:     m.Irq + x.Irq*w,
+		Softirq: m.Softirq + x.Softirq*w,
+		Steal:   m.Steal + x.Steal*w,
+	}
+}
+
+func addTimes(a, b cpu.TimesStat) cpu.TimesStat {
+	a.User += b.User
+	a.Nice += b.Nice
+	a.System += b.System
+	a.Idle += b.Idle
+	a.Iowait += b.Iowait
+	a.Irq += b.Irq
+	a.Softirq += b.Softirq
+	a.Steal += b.Steal
+	a.Guest += b.Guest
+	a.GuestNice += b.GuestNice
+	return a
+}
@@ -0,0 +1,177 @@
+package stat
+
+import (
+	"sort"
+	"strconv"
+
+	"neko-exporter/metrics"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/net"
+)
+
+func WriteMetrics(w *metrics.Writer) error {
+	snap := Default.Latest()
+	CPU, err := cpu.Times(true)
+	if err != nil {
+		return err
+	}
+	NET, err := net.IOCounters(true)
+	if err != nil {
+		return err
+	}
+	DISK, err := readDiskIO()
+	if err != nil {
+		return err
+	}
+	KERN, err := readKernelCounters()
+	if err != nil {
+		return err
+	}
+	MEM, SWAP, HOST := snap.Mem.Virtual, snap.Mem.Swap, snap.Host
+
+	w.Family("neko_cpu_core_usage_ratio", "CPU utilisation of a single core over the last sampling interval.", metrics.Gauge)
+	for i, v := range snap.CPU.Single {
+		w.Sample("neko_cpu_core_usage_ratio", metrics.Labels{"cpu": "cpu" + strconv.Itoa(i)}, v)
+	}
+	w.Family("neko_cpu_usage_ratio", "CPU utilisation of all cores over the last sampling interval.", metrics.Gauge)
+	w.Sample("neko_cpu_usage_ratio", nil, snap.CPU.Multi)
+	w.Family("neko_cpu_seconds_total", "Seconds the CPUs spent in each mode.", metrics.Counter)
+	for _, c := range CPU {
+		for _, m := range []struct {
+			mode  string
+			value float64
+		}{
+			{"user", c.User},
+			{"nice", c.Nice},
+			{"system", c.System},
+			{"idle", c.Idle},
+			{"iowait", c.Iowait},
+			{"irq", c.Irq},
+			{"softirq", c.Softirq},
+			{"steal", c.Steal},
+		} {
+			w.Sample("neko_cpu_seconds_total", metrics.Labels{"cpu": c.CPU, "mode": m.mode}, m.value)
+		}
+	}
+
+	for _, g := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"neko_memory_total_bytes", "Total physical memory.", MEM.Total},
+		{"neko_memory_used_bytes", "Used physical memory.", MEM.Used},
+		{"neko_memory_available_bytes", "Memory available for new processes.", MEM.Available},
+		{"neko_memory_free_bytes", "Unused physical memory.", MEM.Free},
+		{"neko_memory_buffers_bytes", "Memory used by kernel buffers.", MEM.Buffers},
+		{"neko_memory_cached_bytes", "Memory used by the page cache.", MEM.Cached},
+		{"neko_swap_total_bytes", "Total swap space.", SWAP.Total},
+		{"neko_swap_used_bytes", "Used swap space.", SWAP.Used},
+		{"neko_swap_free_bytes", "Unused swap space.", SWAP.Free},
+	} {
+		w.Family(g.name, g.help, metrics.Gauge)
+		w.Sample(g.name, nil, float64(g.value))
+	}
+
+	for _, c := range []struct {
+		name, help string
+		value      func(net.IOCountersStat) uint64
+	}{
+		{"neko_network_receive_bytes_total", "Bytes received by the interface.", func(x net.IOCountersStat) uint64 { return x.BytesRecv }},
+		{"neko_network_transmit_bytes_total", "Bytes sent by the interface.", func(x net.IOCountersStat) uint64 { return x.BytesSent }},
+		{"neko_network_receive_packets_total", "Packets received by the interface.", func(x net.IOCountersStat) uint64 { return x.PacketsRecv }},
+		{"neko_network_transmit_packets_total", "Packets sent by the interface.", func(x net.IOCountersStat) uint64 { return x.PacketsSent }},
+	} {
+		w.Family(c.name, c.help, metrics.Counter)
+		for _, x := range NET {
+			w.Sample(c.name, metrics.Labels{"device": x.Name}, float64(c.value(x)))
+		}
+	}
+
+	for _, g := range []struct {
+		name, help string
+		value      func(Mount) uint64
+	}{
+		{"neko_filesystem_size_bytes", "Filesystem size.", func(m Mount) uint64 { return m.Total }},
+		{"neko_filesystem_used_bytes", "Used filesystem space.", func(m Mount) uint64 { return m.Used }},
+		{"neko_filesystem_free_bytes", "Free filesystem space.", func(m Mount) uint64 { return m.Free }},
+		{"neko_filesystem_inodes", "Total filesystem inodes.", func(m Mount) uint64 { return m.InodesTotal }},
+		{"neko_filesystem_inodes_used", "Used filesystem inodes.", func(m Mount) uint64 { return m.InodesUsed }},
+	} {
+		w.Family(g.name, g.help, metrics.Gauge)
+		for _, m := range snap.Disk.Mounts {
+			w.Sample(g.name, metrics.Labels{"mountpoint": m.Mountpoint, "device": m.Device, "fstype": m.Fstype}, float64(g.value(m)))
+		}
+	}
+
+	for _, c := range []struct {
+		name, help string
+		value      func(disk.IOCountersStat) float64
+	}{
+		{"neko_disk_read_bytes_total", "Bytes read from the device.", func(d disk.IOCountersStat) float64 { return float64(d.ReadBytes) }},
+		{"neko_disk_written_bytes_total", "Bytes written to the device.", func(d disk.IOCountersStat) float64 { return float64(d.WriteBytes) }},
+		{"neko_disk_reads_completed_total", "Reads completed by the device.", func(d disk.IOCountersStat) float64 { return float64(d.ReadCount) }},
+		{"neko_disk_writes_completed_total", "Writes completed by the device.", func(d disk.IOCountersStat) float64 { return float64(d.WriteCount) }},
+		{"neko_disk_read_time_seconds_total", "Seconds spent reading.", func(d disk.IOCountersStat) float64 { return float64(d.ReadTime) / 1000 }},
+		{"neko_disk_write_time_seconds_total", "Seconds spent writing.", func(d disk.IOCountersStat) float64 { return float64(d.WriteTime) / 1000 }},
+		{"neko_disk_io_time_seconds_total", "Seconds the device was busy.", func(d disk.IOCountersStat) float64 { return float64(d.IoTime) / 1000 }},
+	} {
+		w.Family(c.name, c.help, metrics.Counter)
+		for _, name := range sortedKeys(DISK) {
+			w.Sample(c.name, metrics.Labels{"device": name}, c.value(DISK[name]))
+		}
+	}
+
+	LOAD := snap.Load
+	for _, g := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"neko_load1", "1 minute load average.", LOAD.Load1},
+		{"neko_load5", "5 minute load average.", LOAD.Load5},
+		{"neko_load15", "15 minute load average.", LOAD.Load15},
+		{"neko_procs_total", "Number of processes.", float64(LOAD.ProcsTotal)},
+		{"neko_procs_running", "Number of runnable processes.", float64(LOAD.ProcsRunning)},
+		{"neko_procs_blocked", "Number of processes blocked on IO.", float64(LOAD.ProcsBlocked)},
+	} {
+		w.Family(g.name, g.help, metrics.Gauge)
+		w.Sample(g.name, nil, g.value)
+	}
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"neko_context_switches_total", "Context switches since boot.", KERN.ctxt},
+		{"neko_interrupts_total", "Interrupts serviced since boot.", KERN.intr},
+		{"neko_forks_total", "Processes created since boot.", KERN.forks},
+	} {
+		w.Family(c.name, c.help, metrics.Counter)
+		w.Sample(c.name, nil, float64(c.value))
+	}
+
+	w.Family("neko_host_info", "Host information, value is always 1.", metrics.Gauge)
+	w.Sample("neko_host_info", metrics.Labels{
+		"hostname":         HOST.Hostname,
+		"os":               HOST.OS,
+		"platform":         HOST.Platform,
+		"platform_version": HOST.PlatformVersion,
+		"kernel_version":   HOST.KernelVersion,
+		"kernel_arch":      HOST.KernelArch,
+		"virtualization":   HOST.Virtualization,
+	}, 1)
+	w.Family("neko_host_boot_time_seconds", "Unix time the host booted.", metrics.Gauge)
+	w.Sample("neko_host_boot_time_seconds", nil, float64(HOST.BootTime))
+	w.Family("neko_host_uptime_seconds", "Seconds since the host booted.", metrics.Gauge)
+	w.Sample("neko_host_uptime_seconds", nil, float64(HOST.Uptime))
+	return nil
+}
+
+func sortedKeys(m map[string]disk.IOCountersStat) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,210 @@
+package stat
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Sampler reads the counters once every Resolution, keeps the last History
+// snapshots and fans them out to subscribers, so requests never block on
+// /proc and rates are computed once for everybody.
+type Sampler struct {
+	Resolution time.Duration
+	History    int
+
+	once  sync.Once
+	ready chan struct{}
+	mu    sync.RWMutex
+	ring  []Snapshot
+	next  int
+	full  bool
+	subs  map[chan Snapshot]struct{}
+}
+
+var Default = &Sampler{Resolution: time.Second, History: 60}
+
+func (s *Sampler) Start() {
+	s.once.Do(func() {
+		if s.Resolution <= 0 {
+			s.Resolution = time.Second
+		}
+		if s.History <= 0 {
+			s.History = 1
+		}
+		s.ready = make(chan struct{})
+		s.ring = make([]Snapshot, s.History)
+		s.subs = map[chan Snapshot]struct{}{}
+		go s.run()
+	})
+}
+
+func (s *Sampler) run() {
+	var s1 sample
+	var err error
+	for {
+		if s1, err = readSample(); err == nil {
+			break
+		}
+		log.Println("stat:", err)
+		time.Sleep(s.Resolution)
+	}
+	t := time.NewTicker(s.Resolution)
+	defer t.Stop()
+	for range t.C {
+		s2, err := readSample()
+		if err != nil {
+			log.Println("stat:", err)
+			continue
+		}
+		snap, err := build(s1, s2)
+		if err != nil {
+			log.Println("stat:", err)
+			continue
+		}
+		s1 = s2
+		s.push(snap)
+	}
+}
+
+func (s *Sampler) push(snap Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := s.next == 0 && !s.full
+	s.ring[s.next] = snap
+	if s.next = (s.next + 1) % len(s.ring); s.next == 0 {
+		s.full = true
+	}
+	if first {
+		close(s.ready)
+	}
+	for ch := range s.subs {
+		// a slow subscriber only ever misses intermediate snapshots
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- snap
+	}
+}
+
+// Latest returns the most recent snapshot, waiting for the first one after
+// start.
+func (s *Sampler) Latest() Snapshot {
+	s.Start()
+	<-s.ready
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring[(s.next+len(s.ring)-1)%len(s.ring)]
+}
+
+// Recent returns the kept snapshots, oldest first.
+func (s *Sampler) Recent() []Snapshot {
+	s.Start()
+	<-s.ready
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.full {
+		return append([]Snapshot(nil), s.ring[:s.next]...)
+	}
+	return append(append([]Snapshot(nil), s.ring[s.next:]...), s.ring[:s.next]...)
+}
+
+// Subscribe returns a channel receiving every new snapshot and a function
+// that must be called to unsubscribe.
+func (s *Sampler) Subscribe() (<-chan Snapshot, func()) {
+	s.Start()
+	ch := make(chan Snapshot, 1)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}
+}
+
+// merge combines consecutive snapshots into one covering their whole
+// interval: rates and utilisation are averaged weighted by each snapshot's
+// interval, everything else comes from the last one.
+func merge(snaps []Snapshot) Snapshot {
+	res := snaps[len(snaps)-1]
+	if len(snaps) == 1 {
+		return res
+	}
+	var total float64
+	for _, x := range snaps {
+		total += float64(x.Interval)
+	}
+	if total == 0 {
+		return res
+	}
+	res.Interval = int64(total)
+	res.CPU = CPU{
+		Single: make([]float64, len(res.CPU.Single)),
+		Cores:  make([]CPUModes, len(res.CPU.Cores)),
+	}
+	res.Load.ContextSwitches, res.Load.Interrupts, res.Load.Forks = 0, 0, 0
+	res.Net.Delta = NetRate{}
+	devices := make(map[string]NetDevice, len(res.Net.Devices))
+	for name, dev := range res.Net.Devices {
+		dev.Delta = NetRate{}
+		devices[name] = dev
+	}
+	res.Net.Devices = devices
+	disks := make(map[string]DiskDevice, len(res.Disk.Devices))
+	for name := range res.Disk.Devices {
+		disks[name] = DiskDevice{}
+	}
+	res.Disk.Devices = disks
+	// await is a mean per IO, so it is weighted by the IOs of each interval
+	ios := map[string]float64{}
+	for _, x := range snaps {
+		w := float64(x.Interval) / total
+		res.CPU.Multi += x.CPU.Multi * w
+		res.CPU.Modes = res.CPU.Modes.add(x.CPU.Modes, w)
+		for i := range res.CPU.Single {
+			if i < len(x.CPU.Single) {
+				res.CPU.Single[i] += x.CPU.Single[i] * w
+			}
+		}
+		for i := range res.CPU.Cores {
+			if i < len(x.CPU.Cores) {
+				res.CPU.Cores[i] = res.CPU.Cores[i].add(x.CPU.Cores[i], w)
+			}
+		}
+		res.Load.ContextSwitches += x.Load.ContextSwitches * w
+		res.Load.Interrupts += x.Load.Interrupts * w
+		res.Load.Forks += x.Load.Forks * w
+		res.Net.Delta.In += x.Net.Delta.In * w
+		res.Net.Delta.Out += x.Net.Delta.Out * w
+		for name, dev := range x.Net.Devices {
+			if d, ok := devices[name]; ok {
+				d.Delta.In += dev.Delta.In * w
+				d.Delta.Out += dev.Delta.Out * w
+				devices[name] = d
+			}
+		}
+		for name, dev := range x.Disk.Devices {
+			if d, ok := disks[name]; ok {
+				d.ReadBytes += dev.ReadBytes * w
+				d.WriteBytes += dev.WriteBytes * w
+				d.ReadOps += dev.ReadOps * w
+				d.WriteOps += dev.WriteOps * w
+				d.Util += dev.Util * w
+				n := (dev.ReadOps + dev.WriteOps) * w
+				d.Await += dev.Await * n
+				ios[name] += n
+				disks[name] = d
+			}
+		}
+	}
+	for name, n := range ios {
+		if d := disks[name]; n > 0 {
+			d.Await /= n
+			disks[name] = d
+		}
+	}
+	return res
+}
@@ -0,0 +1,92 @@
+package stat
+
+// SchemaVersion is bumped whenever a field of Snapshot is renamed, removed
+// or changes meaning. Adding fields doesn't bump it.
+const SchemaVersion = 1
+
+type Snapshot struct {
+	SchemaVersion int   `json:"schema_version"`
+	Time          int64 `json:"time"`     // unix milliseconds
+	Interval      int64 `json:"interval"` // milliseconds the rates are averaged over
+	CPU           CPU   `json:"cpu"`
+	Mem           Mem   `json:"mem"`
+	Net           Net   `json:"net"`
+	Host          Host  `json:"host"`
+	Disk          Disk  `json:"disk"`
+	Load          Load  `json:"load"`
+
+	// Counters are extra monotonic counters of the application, such as
+	// rejected requests, by name.
+	Counters map[string]uint64 `json:"counters,omitempty"`
+}
+
+// CPU utilisation in the range 0-1, Modes and Cores split it by mode for
+// all cores and each core.
+type CPU struct {
+	Multi  float64    `json:"multi"`
+	Single []float64  `json:"single"`
+	Modes  CPUModes   `json:"modes"`
+	Cores  []CPUModes `json:"cores"`
+}
+
+type Mem struct {
+	Virtual VirtualMem `json:"virtual"`
+	Swap    SwapMem    `json:"swap"`
+}
+
+type VirtualMem struct {
+	Total       uint64  `json:"total"`
+	Available   uint64  `json:"available"`
+	Used        uint64  `json:"used"`
+	Free        uint64  `json:"free"`
+	Buffers     uint64  `json:"buffers"`
+	Cached      uint64  `json:"cached"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+type SwapMem struct {
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	Free        uint64  `json:"free"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// Net totals skip loopback and tun/tap devices, Devices lists every
+// interface.
+type Net struct {
+	Delta   NetRate              `json:"delta"`
+	Total   NetTotal             `json:"total"`
+	Devices map[string]NetDevice `json:"devices"`
+}
+
+// NetRate is in bytes per second.
+type NetRate struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// NetTotal is in bytes since boot.
+type NetTotal struct {
+	In  uint64 `json:"in"`
+	Out uint64 `json:"out"`
+}
+
+type NetDevice struct {
+	Delta NetRate  `json:"delta"`
+	Total NetTotal `json:"total"`
+}
+
+type Host struct {
+	Hostname           string `json:"hostname"`
+	OS                 string `json:"os"`
+	Platform           string `json:"platform"`
+	PlatformFamily     string `json:"platform_family"`
+	PlatformVersion    string `json:"platform_version"`
+	KernelVersion      string `json:"kernel_version"`
+	KernelArch         string `json:"kernel_arch"`
+	Virtualization     string `json:"virtualization"`
+	VirtualizationRole string `json:"virtualization_role"`
+	BootTime           uint64 `json:"boot_time"`
+	Uptime             uint64 `json:"uptime"`
+	Procs              uint64 `json:"procs"`
+}
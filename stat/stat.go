@@ -1,202 +1,229 @@
 package stat
 
 import (
-	"strings"
+	"context"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/host"
 	"github.com/shirou/gopsutil/mem"
 	"github.com/shirou/gopsutil/net"
 )
 
-func GetStat() (map[string]interface{}, error) {
-	timer := time.NewTimer(300 * time.Millisecond)
-	res := gin.H{}
-	CPU1, err := cpu.Times(true)
-	if err != nil {
-		return nil, err
+// sample holds the raw counters rates are computed from.
+type sample struct {
+	time time.Time
+	cpu  []cpu.TimesStat
+	net  []net.IOCountersStat
+	disk map[string]disk.IOCountersStat
+	kern kernelCounters
+}
+
+func readSample() (s sample, err error) {
+	s.time = time.Now()
+	if s.cpu, err = cpu.Times(true); err != nil {
+		return
 	}
-	NET1, err := net.IOCounters(true)
-	if err != nil {
-		return nil, err
+	if s.net, err = net.IOCounters(true); err != nil {
+		return
 	}
-	<-timer.C
-	CPU2, err := cpu.Times(true)
-	if err != nil {
-		return nil, err
+	if s.disk, err = readDiskIO(); err != nil {
+		return
 	}
-	NET2, err := net.IOCounters(true)
-	if err != nil {
-		return nil, err
+	s.kern, err = readKernelCounters()
+	return
+}
+
+func countedDevice(name string) bool {
+	return name != "lo"
+}
+
+func usage(c1, c2 cpu.TimesStat) float64 {
+	total := c2.Total() - c1.Total()
+	if total <= 0 {
+		return 0
+	}
+	return 1 - (c2.Idle-c1.Idle)/total
+}
+
+// Counters, when set, is called for every snapshot to fill in
+// Snapshot.Counters.
+var Counters func() map[string]uint64
+
+// build computes a Snapshot from two samples and the current memory and
+// host info.
+func build(s1, s2 sample) (Snapshot, error) {
+	res := Snapshot{
+		SchemaVersion: SchemaVersion,
+		Time:          s2.time.UnixNano() / int64(time.Millisecond),
+		Interval:      int64(s2.time.Sub(s1.time) / time.Millisecond),
 	}
 	MEM, err := mem.VirtualMemory()
 	if err != nil {
-		return nil, err
+		return res, err
 	}
 	SWAP, err := mem.SwapMemory()
 	if err != nil {
-		return nil, err
-	}
-	res["mem"] = gin.H{
-		"virtual": MEM,
-		"swap":    SWAP,
-	}
-	single := make([]float64, len(CPU1))
-	var idle, total, multi float64
-	idle, total = 0, 0
-	for i, c1 := range CPU1 {
-		c2 := CPU2[i]
-		single[i] = 1 - (c2.Idle-c1.Idle)/(c2.Total()-c1.Total())
-		idle += c2.Idle - c1.Idle
-		total += c2.Total() - c1.Total()
-	}
-	multi = 1 - idle/total
-	res["cpu"] = gin.H{
-		"multi":  multi,
-		"single": single,
-	}
-	var in, out, in_total, out_total uint64
-	in, out, in_total, out_total = 0, 0, 0, 0
-	res["net"] = gin.H{
-		"devices": gin.H{},
-	}
-	for i, x := range NET2 {
-		_in := x.BytesRecv - NET1[i].BytesRecv
-		_out := x.BytesSent - NET1[i].BytesSent
-		res["net"].(gin.H)["devices"].(gin.H)[x.Name] = gin.H{
-			"delta": gin.H{
-				"in":  float64(_in) / 0.3,
-				"out": float64(_out) / 0.3,
-			},
-			"total": gin.H{
-				"in":  x.BytesRecv,
-				"out": x.BytesSent,
-			},
+		return res, err
+	}
+	HOST, err := host.Info()
+	if err != nil {
+		return res, err
+	}
+	res.Mem = Mem{
+		Virtual: VirtualMem{
+			Total:       MEM.Total,
+			Available:   MEM.Available,
+			Used:        MEM.Used,
+			Free:        MEM.Free,
+			Buffers:     MEM.Buffers,
+			Cached:      MEM.Cached,
+			UsedPercent: MEM.UsedPercent,
+		},
+		Swap: SwapMem{
+			Total:       SWAP.Total,
+			Used:        SWAP.Used,
+			Free:        SWAP.Free,
+			UsedPercent: SWAP.UsedPercent,
+		},
+	}
+	res.Host = Host{
+		Hostname:           HOST.Hostname,
+		OS:                 HOST.OS,
+		Platform:           HOST.Platform,
+		PlatformFamily:     HOST.PlatformFamily,
+		PlatformVersion:    HOST.PlatformVersion,
+		KernelVersion:      HOST.KernelVersion,
+		KernelArch:         HOST.KernelArch,
+		Virtualization:     HOST.VirtualizationSystem,
+		VirtualizationRole: HOST.VirtualizationRole,
+		BootTime:           HOST.BootTime,
+		Uptime:             HOST.Uptime,
+		Procs:              HOST.Procs,
+	}
+
+	res.CPU.Single = make([]float64, 0, len(s2.cpu))
+	res.CPU.Cores = make([]CPUModes, 0, len(s2.cpu))
+	var sum1, sum2 cpu.TimesStat
+	for i, c2 := range s2.cpu {
+		if i >= len(s1.cpu) {
+			break
+		}
+		c1 := s1.cpu[i]
+		res.CPU.Single = append(res.CPU.Single, usage(c1, c2))
+		res.CPU.Cores = append(res.CPU.Cores, modes(c1, c2))
+		sum1, sum2 = addTimes(sum1, c1), addTimes(sum2, c2)
+	}
+	res.CPU.Multi = usage(sum1, sum2)
+	res.CPU.Modes = modes(sum1, sum2)
+
+	elapsed := s2.time.Sub(s1.time).Seconds()
+	if res.Load, err = readLoad(s1.kern, s2.kern, elapsed); err != nil {
+		return res, err
+	}
+	prev := make(map[string]net.IOCountersStat, len(s1.net))
+	for _, x := range s1.net {
+		prev[x.Name] = x
+	}
+	res.Net.Devices = make(map[string]NetDevice, len(s2.net))
+	var in, out uint64
+	for _, x := range s2.net {
+		dev := NetDevice{
+			Total: NetTotal{In: x.BytesRecv, Out: x.BytesSent},
+		}
+		var _in, _out uint64
+		if p, ok := prev[x.Name]; ok && x.BytesRecv >= p.BytesRecv && x.BytesSent >= p.BytesSent {
+			_in, _out = x.BytesRecv-p.BytesRecv, x.BytesSent-p.BytesSent
+		}
+		if elapsed > 0 {
+			dev.Delta = NetRate{In: float64(_in) / elapsed, Out: float64(_out) / elapsed}
 		}
-		if x.Name == "lo" {
+		res.Net.Devices[x.Name] = dev
+		if !countedDevice(x.Name) {
 			continue
 		}
 		in += _in
 		out += _out
-		in_total += x.BytesRecv
-		out_total += x.BytesSent
+		res.Net.Total.In += x.BytesRecv
+		res.Net.Total.Out += x.BytesSent
 	}
-	res["net"].(gin.H)["delta"] = gin.H{
-		"in":  float64(in) / 0.3,
-		"out": float64(out) / 0.3,
+	if elapsed > 0 {
+		res.Net.Delta = NetRate{In: float64(in) / elapsed, Out: float64(out) / elapsed}
 	}
-	res["net"].(gin.H)["total"] = gin.H{
-		"in":  in_total,
-		"out": out_total,
+
+	if res.Disk.Mounts, err = readMounts(); err != nil {
+		return res, err
 	}
-	host, err := host.Info()
-	if err != nil {
-		return nil, err
+	res.Disk.Devices = diskDevices(s1.disk, s2.disk, elapsed)
+	if Counters != nil {
+		res.Counters = Counters()
 	}
-	res["host"] = host
 	return res, nil
 }
 
-func StatWs(interval int, ws *websocket.Conn) {
+// GetStat returns the latest snapshot of the default sampler.
+func GetStat() (Snapshot, error) {
+	return Default.Latest(), nil
+}
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+)
+
+// StatWs streams filtered snapshots of the default sampler every interval,
+// merging samples when interval is coarser than the sampler's resolution.
+// It pings the client to keep the connection alive and returns as soon as
+// the client goes away, or with a going away frame once ctx is done.
+func StatWs(ctx context.Context, interval time.Duration, filter Filter, ws *websocket.Conn) {
 	defer ws.Close()
-	CPU1, err := cpu.Times(true)
-	if err != nil {
-		ws.WriteJSON(gin.H{"error": err})
-		return
-	}
-	NET1, err := net.IOCounters(true)
-	if err != nil {
-		ws.WriteJSON(gin.H{"error": err})
-		return
-	}
-	t := time.NewTicker(time.Duration(interval) * time.Millisecond)
-	defer t.Stop()
-	for {
-		<-t.C
-		CPU2, err := cpu.Times(true)
-		if err != nil {
-			ws.WriteJSON(gin.H{"error": err})
-			return
-		}
-		NET2, err := net.IOCounters(true)
-		if err != nil {
-			ws.WriteJSON(gin.H{"error": err})
-			return
+	ch, cancel := Default.Subscribe()
+	defer cancel()
+
+	done := make(chan struct{})
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
 		}
-		MEM, err := mem.VirtualMemory()
-		if err != nil {
-			ws.WriteJSON(gin.H{"error": err})
+	}()
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	window := int64((interval - Default.Resolution/2) / time.Millisecond)
+	var pending []Snapshot
+	var elapsed int64
+	for {
+		select {
+		case <-done:
 			return
-		}
-		SWAP, err := mem.SwapMemory()
-		if err != nil {
-			ws.WriteJSON(gin.H{"error": err})
+		case <-ctx.Done():
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(writeWait))
 			return
-		}
-		res := gin.H{}
-		res["mem"] = gin.H{
-			"virtual": MEM,
-			"swap":    SWAP,
-		}
-		single := make([]float64, len(CPU1))
-		var idle, total, multi float64
-		idle, total = 0, 0
-		for i, c1 := range CPU1 {
-			c2 := CPU2[i]
-			single[i] = 1 - (c2.Idle-c1.Idle)/(c2.Total()-c1.Total())
-			idle += c2.Idle - c1.Idle
-			total += c2.Total() - c1.Total()
-		}
-		multi = 1 - idle/total
-		res["cpu"] = gin.H{
-			"multi":  multi,
-			"single": single,
-		}
-		var in, out, in_total, out_total uint64
-		in, out, in_total, out_total = 0, 0, 0, 0
-		res["net"] = gin.H{
-			"devices": gin.H{},
-		}
-		for i, x := range NET2 {
-			_in := x.BytesRecv - NET1[i].BytesRecv
-			_out := x.BytesSent - NET1[i].BytesSent
-			res["net"].(gin.H)["devices"].(gin.H)[x.Name] = gin.H{
-				"delta": gin.H{
-					"in":  float64(_in) / 0.3,
-					"out": float64(_out) / 0.3,
-				},
-				"total": gin.H{
-					"in":  x.BytesRecv,
-					"out": x.BytesSent,
-				},
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
 			}
-			if x.Name == "lo" || strings.HasPrefix(x.Name, "tap") || strings.HasPrefix(x.Name, "tun") {
+		case snap := <-ch:
+			pending = append(pending, snap)
+			if elapsed += snap.Interval; elapsed < window {
 				continue
 			}
-			in += _in
-			out += _out
-			in_total += x.BytesRecv
-			out_total += x.BytesSent
-		}
-		res["net"].(gin.H)["delta"] = gin.H{
-			"in":  float64(in) / 0.3,
-			"out": float64(out) / 0.3,
-		}
-		res["net"].(gin.H)["total"] = gin.H{
-			"in":  in_total,
-			"out": out_total,
-		}
-		host, err := host.Info()
-		if err != nil {
-			ws.WriteJSON(gin.H{"error": err})
-			return
+			res := filter.Apply(merge(pending))
+			pending, elapsed = pending[:0], 0
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteJSON(res); err != nil {
+				return
+			}
 		}
-		res["host"] = host
-		NET1 = NET2
-		CPU1 = CPU2
-		ws.WriteJSON(res)
 	}
 }
@@ -0,0 +1,451 @@
+package throughput
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"neko-exporter/iperf3"
+)
+
+// Options of a test. Rate is in bits per second over all streams, udp tests
+// default to DefaultUDPRate. Len is the size of the writes and datagrams.
+type Options struct {
+	Host     string
+	Port     int
+	Protocol string
+	Streams  int
+	Time     int
+	Reverse  bool
+	Rate     uint64
+	Len      int
+	Secret   string
+}
+
+func (o *Options) defaults() {
+	if o.Port == 0 {
+		o.Port = DefaultPort
+	}
+	if o.Protocol == "" {
+		o.Protocol = "tcp"
+	}
+	if o.Streams == 0 {
+		o.Streams = 1
+	}
+	if o.Time == 0 {
+		o.Time = 10
+	}
+	if o.Protocol == "udp" && o.Rate == 0 {
+		o.Rate = DefaultUDPRate
+	}
+	if o.Len == 0 {
+		o.Len = DefaultTCPLen
+		if o.Protocol == "udp" {
+			o.Len = DefaultUDPLen
+		}
+	}
+}
+
+// closer closes the connections of a test at once, also those added after.
+type closer struct {
+	mu     sync.Mutex
+	conns  []io.Closer
+	closed bool
+}
+
+func (c *closer) add(x io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		x.Close()
+		return
+	}
+	c.conns = append(c.conns, x)
+}
+
+func (c *closer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, x := range c.conns {
+		x.Close()
+	}
+}
+
+type clientStream struct {
+	counter
+	conn net.Conn
+	prev streamStats
+}
+
+// Client runs a test against a Server, streaming the intervals and the
+// result to ws like iperf3.Client. Failures of the test are reported in
+// the result.
+func Client(ctx context.Context, opt Options, ws iperf3.Conn) (res iperf3.Result, err error) {
+	opt.defaults()
+	if er := run(ctx, opt, &res, ws); er != nil {
+		res.Success = false
+		res.Err = er.Error()
+	}
+	if ws != nil {
+		ws.WriteJSON(res)
+		ws.Close()
+	}
+	return
+}
+
+func run(ctx context.Context, opt Options, res *iperf3.Result, ws iperf3.Conn) error {
+	if opt.Protocol != "tcp" && opt.Protocol != "udp" {
+		return fmt.Errorf("unknown protocol %q", opt.Protocol)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var conns closer
+	defer conns.close()
+	go func() {
+		<-ctx.Done()
+		conns.close()
+	}()
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	d := net.Dialer{Timeout: connectWait}
+	addr := net.JoinHostPort(opt.Host, strconv.Itoa(opt.Port))
+	ctrl, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fail(err)
+	}
+	conns.add(ctrl)
+	br := bufio.NewReader(ctrl)
+	h := hello{
+		Cookie:   newCookie(),
+		Secret:   opt.Secret,
+		Protocol: opt.Protocol,
+		Streams:  opt.Streams,
+		Time:     opt.Time,
+		Reverse:  opt.Reverse,
+		Rate:     opt.Rate,
+		Len:      opt.Len,
+	}
+	if err := writeLine(ctrl, h); err != nil {
+		return fail(err)
+	}
+	ctrl.SetReadDeadline(time.Now().Add(connectWait))
+	var r reply
+	if err := readLine(br, &r); err != nil {
+		return fail(err)
+	}
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
+	if opt.Rate == 0 {
+		opt.Rate = r.Rate
+	}
+
+	id := testID(h.Cookie)
+	res.Start = &iperf3.Start{
+		Version:    Version,
+		Protocol:   map[string]string{"tcp": "TCP", "udp": "UDP"}[opt.Protocol],
+		NumStreams: opt.Streams,
+		Blksize:    opt.Len,
+		Duration:   opt.Time,
+		Reverse:    opt.Reverse,
+	}
+	streams := make([]*clientStream, opt.Streams)
+	for i := range streams {
+		conn, err := d.DialContext(ctx, opt.Protocol, addr)
+		if err != nil {
+			return fail(err)
+		}
+		conns.add(conn)
+		if opt.Protocol == "tcp" {
+			if err := writeLine(conn, hello{Cookie: h.Cookie, Stream: i + 1}); err != nil {
+				return fail(err)
+			}
+		}
+		streams[i] = &clientStream{conn: conn}
+		local, remote := conn.LocalAddr(), conn.RemoteAddr()
+		c := iperf3.Connection{Socket: i + 1}
+		c.LocalHost, c.LocalPort = splitAddr(local)
+		c.RemoteHost, c.RemotePort = splitAddr(remote)
+		res.Start.Connected = append(res.Start.Connected, c)
+	}
+	started := make(chan struct{})
+	defer func() {
+		select {
+		case <-started:
+		default:
+			close(started)
+		}
+	}()
+	if opt.Protocol == "udp" {
+		// datagrams may get lost, say hello until the server saw them all
+		go func() {
+			buf := make([]byte, header)
+			for {
+				for i, st := range streams {
+					datagram{id: id, stream: uint32(i + 1)}.put(buf)
+					st.conn.Write(buf)
+				}
+				select {
+				case <-started:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		}()
+	}
+	ctrl.SetReadDeadline(time.Now().Add(2 * connectWait))
+	if err := readLine(br, &r); err != nil {
+		return fail(err)
+	}
+	close(started)
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
+	ctrl.SetReadDeadline(time.Time{})
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(opt.Time) * time.Second)
+	rate := float64(opt.Rate) / float64(opt.Streams)
+	var wg sync.WaitGroup
+	for i, st := range streams {
+		wg.Add(1)
+		go func(i int, st *clientStream) {
+			defer wg.Done()
+			switch {
+			case !opt.Reverse && opt.Protocol == "tcp":
+				sendTCP(ctx, st.conn, deadline, rate, opt.Len, &st.counter)
+			case !opt.Reverse:
+				sendUDP(ctx, st.conn.Write, id, i+1, deadline, rate, opt.Len, &st.counter)
+			case opt.Protocol == "tcp":
+				receiveTCP(st.conn, &st.counter)
+			default:
+				receiveUDP(st.conn, id, &st.counter)
+			}
+		}(i, st)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	last := start
+	report := func(now time.Time) {
+		res.Stats = append(res.Stats, interval(streams, last.Sub(start), now.Sub(start), !opt.Reverse))
+		last = now
+		if ws != nil {
+			ws.WriteJSON(res.Stats[len(res.Stats)-1])
+		}
+	}
+	until := func(ch <-chan struct{}) bool {
+		for {
+			select {
+			case <-ch:
+				return true
+			case now := <-tick.C:
+				report(now)
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+
+	final := make(chan struct{})
+	// seconds is how long this end sent or received
+	var seconds float64
+	if !opt.Reverse {
+		if !until(finished) {
+			return ctx.Err()
+		}
+		seconds = time.Since(start).Seconds()
+		if now := time.Now(); now.Sub(last) >= 100*time.Millisecond {
+			report(now)
+		}
+		for _, st := range streams {
+			if opt.Protocol == "tcp" {
+				st.conn.Close()
+			}
+		}
+		if err := writeLine(ctrl, done{Done: true}); err != nil {
+			return fail(err)
+		}
+	}
+	go func() {
+		defer close(final)
+		ctrl.SetReadDeadline(deadline.Add(3 * connectWait))
+		if err := readLine(br, &r); err != nil {
+			r = reply{Err: fail(err).Error()}
+		}
+	}()
+	if !until(final) {
+		return ctx.Err()
+	}
+	if opt.Reverse {
+		// the server finished sending, collect what is still in flight
+		if opt.Protocol == "udp" {
+			time.Sleep(udpGrace)
+			for _, st := range streams {
+				st.conn.Close()
+			}
+		}
+		select {
+		case <-finished:
+		case <-time.After(connectWait):
+			conns.close()
+		}
+	}
+	if now := time.Now(); opt.Reverse && now.Sub(last) >= 100*time.Millisecond {
+		report(now)
+	}
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
+	if len(r.Streams) != len(streams) {
+		return errors.New("incomplete result from server")
+	}
+	if opt.Reverse {
+		seconds = r.Seconds
+	}
+	total(res, streams, r, seconds, opt.Reverse)
+	return nil
+}
+
+// receiveUDP reads the datagrams of a test from conn until it is closed.
+func receiveUDP(conn net.Conn, id uint64, c *counter) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		if d, ok := parseDatagram(buf[:n]); ok && d.id == id && d.seq > 0 {
+			c.receive(n, d, now)
+		}
+	}
+}
+
+func splitAddr(a net.Addr) (string, int) {
+	host, port, _ := net.SplitHostPort(a.String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func toStream(socket int, s streamStats, from, to float64, sender bool) iperf3.Stream {
+	st := iperf3.Stream{
+		Socket:      socket,
+		Start:       from,
+		End:         to,
+		Seconds:     to - from,
+		Bytes:       s.Bytes,
+		Packets:     int(s.Packets),
+		LostPackets: int(s.Lost),
+		OutOfOrder:  int(s.OutOfOrder),
+		JitterMs:    s.JitterMs,
+		Sender:      sender,
+	}
+	if st.Seconds > 0 {
+		st.BitsPerSecond = float64(s.Bytes) * 8 / st.Seconds
+	}
+	if n := s.Packets + s.Lost; n > 0 && !sender {
+		st.LostPercent = float64(s.Lost) * 100 / float64(n)
+	}
+	return st
+}
+
+func sum(stats []streamStats) streamStats {
+	var res streamStats
+	for _, s := range stats {
+		res.Bytes += s.Bytes
+		res.Packets += s.Packets
+		res.Lost += s.Lost
+		res.OutOfOrder += s.OutOfOrder
+		res.JitterMs += s.JitterMs / float64(len(stats))
+	}
+	return res
+}
+
+func toStat(typ string, s iperf3.Stream, streams []iperf3.Stream) iperf3.Stat {
+	return iperf3.Stat{
+		Type:     typ,
+		Interval: fmt.Sprintf("%.2f-%.2f", s.Start, s.End),
+		Transfer: s.Bytes,
+		Bitrate:  s.BitsPerSecond / 1e6,
+		Sum:      &s,
+		Streams:  streams,
+	}
+}
+
+// interval reports what every stream did since the last interval.
+func interval(streams []*clientStream, from, to time.Duration, sender bool) iperf3.Stat {
+	var deltas []streamStats
+	var list []iperf3.Stream
+	for i, st := range streams {
+		cur := st.stats()
+		delta := streamStats{
+			Bytes:      cur.Bytes - st.prev.Bytes,
+			Packets:    cur.Packets - st.prev.Packets,
+			Lost:       cur.Lost - st.prev.Lost,
+			OutOfOrder: cur.OutOfOrder - st.prev.OutOfOrder,
+			JitterMs:   cur.JitterMs,
+		}
+		if cur.Lost < st.prev.Lost {
+			// a late datagram filled a gap
+			delta.Lost = 0
+		}
+		st.prev = cur
+		deltas = append(deltas, delta)
+		list = append(list, toStream(i+1, delta, from.Seconds(), to.Seconds(), sender))
+	}
+	return toStat("interval", toStream(0, sum(deltas), from.Seconds(), to.Seconds(), sender), list)
+}
+
+// total fills in the totals of both ends, seconds is how long this end
+// sent or received.
+func total(res *iperf3.Result, streams []*clientStream, r reply, seconds float64, reverse bool) {
+	local := make([]streamStats, len(streams))
+	for i, st := range streams {
+		local[i] = st.stats()
+	}
+	sent, received := local, r.Streams
+	sentSecs, receivedSecs := seconds, r.Seconds
+	if reverse {
+		sent, received = received, sent
+		sentSecs, receivedSecs = receivedSecs, sentSecs
+	}
+	var list []iperf3.Stream
+	for i := range streams {
+		list = append(list,
+			toStream(i+1, sent[i], 0, sentSecs, true),
+			toStream(i+1, received[i], 0, receivedSecs, false))
+	}
+	s, rcv := toStream(0, sum(sent), 0, sentSecs, true), toStream(0, sum(received), 0, receivedSecs, false)
+	res.Sent, res.Received = &s, &rcv
+	total := s
+	if res.Start.Protocol == "UDP" {
+		// like iperf3, the udp sum has the receiver's losses
+		total.LostPackets, total.LostPercent = rcv.LostPackets, rcv.LostPercent
+		total.OutOfOrder, total.JitterMs = rcv.OutOfOrder, rcv.JitterMs
+	}
+	res.Total = toStat("total", total, list)
+	for _, stat := range res.Stats {
+		if stat.Bitrate > res.Total.Peak {
+			res.Total.Peak = stat.Bitrate
+		}
+	}
+	res.Success = true
+}
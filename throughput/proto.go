@@ -0,0 +1,259 @@
+// Package throughput is a bandwidth test between two exporters, without the
+// iperf3 binary. A test runs over a control connection and one tcp
+// connection or udp flow per stream, all on the server's port.
+package throughput
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version is reported as the iperf3 version of the results.
+const Version = "neko-exporter throughput 1"
+
+const (
+	DefaultPort    = 5301
+	DefaultTCPLen  = 128 * 1024
+	DefaultUDPLen  = 1400
+	DefaultUDPRate = 1000 * 1000
+
+	// header is the size of the udp datagram header: test id, stream,
+	// sequence number and send time.
+	header = 32
+	// maxLen bounds the block size of both protocols.
+	maxLen = 1024 * 1024
+	// connectWait bounds setting a test up, udpGrace is how long a
+	// receiver waits for late datagrams after the sender finished.
+	connectWait = 5 * time.Second
+	udpGrace    = 250 * time.Millisecond
+)
+
+var (
+	ErrBusy   = errors.New("another test is running")
+	ErrSecret = errors.New("wrong secret")
+)
+
+// hello is the first line of every connection. Stream 0 is the control
+// connection carrying the test parameters, data connections and the first
+// datagrams of udp flows name their stream from 1. Rate is in bits per
+// second over all streams, 0 is unlimited or the server's cap.
+type hello struct {
+	Cookie   string
+	Stream   int
+	Secret   string `json:",omitempty"`
+	Protocol string `json:",omitempty"`
+	Streams  int    `json:",omitempty"`
+	Time     int    `json:",omitempty"`
+	Reverse  bool   `json:",omitempty"`
+	Rate     uint64 `json:",omitempty"`
+	Len      int    `json:",omitempty"`
+}
+
+// reply is sent by the server on the control connection: once the test is
+// accepted, with the rate capping a test that asked for none, once every
+// stream connected and at the end with its side's numbers.
+type reply struct {
+	Err     string        `json:",omitempty"`
+	Rate    uint64        `json:",omitempty"`
+	Start   bool          `json:",omitempty"`
+	Seconds float64       `json:",omitempty"`
+	Streams []streamStats `json:",omitempty"`
+}
+
+// done is sent by the client when it finished sending.
+type done struct {
+	Done bool
+}
+
+type streamStats struct {
+	Bytes      uint64
+	Packets    uint64  `json:",omitempty"`
+	Lost       uint64  `json:",omitempty"`
+	OutOfOrder uint64  `json:",omitempty"`
+	JitterMs   float64 `json:",omitempty"`
+}
+
+func newCookie() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// testID is the id of a test in its udp datagrams.
+func testID(cookie string) uint64 {
+	b, _ := hex.DecodeString(cookie)
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func writeLine(c net.Conn, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(append(b, '\n'))
+	return err
+}
+
+func readLine(r *bufio.Reader, v interface{}) error {
+	b, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+type datagram struct {
+	id     uint64
+	stream uint32
+	seq    uint64
+	sent   int64
+}
+
+func (d datagram) put(b []byte) {
+	binary.BigEndian.PutUint64(b[0:], d.id)
+	binary.BigEndian.PutUint32(b[8:], d.stream)
+	binary.BigEndian.PutUint64(b[16:], d.seq)
+	binary.BigEndian.PutUint64(b[24:], uint64(d.sent))
+}
+
+func parseDatagram(b []byte) (d datagram, ok bool) {
+	if len(b) < header {
+		return d, false
+	}
+	d.id = binary.BigEndian.Uint64(b[0:])
+	d.stream = binary.BigEndian.Uint32(b[8:])
+	d.seq = binary.BigEndian.Uint64(b[16:])
+	d.sent = int64(binary.BigEndian.Uint64(b[24:]))
+	return d, true
+}
+
+// counter counts what a stream sent or received. For udp receivers it
+// also tracks losses, reordering and the jitter as in RFC 3550.
+type counter struct {
+	mu         sync.Mutex
+	bytes      uint64
+	packets    uint64
+	maxSeq     uint64
+	outOfOrder uint64
+	jitter     float64
+	transit    int64
+}
+
+func (c *counter) add(n int) {
+	c.mu.Lock()
+	c.bytes += uint64(n)
+	c.mu.Unlock()
+}
+
+func (c *counter) sent(n int) {
+	c.mu.Lock()
+	c.bytes += uint64(n)
+	c.packets++
+	c.mu.Unlock()
+}
+
+func (c *counter) receive(n int, d datagram, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bytes += uint64(n)
+	c.packets++
+	if d.seq > c.maxSeq {
+		c.maxSeq = d.seq
+	} else {
+		c.outOfOrder++
+	}
+	transit := now.UnixNano() - d.sent
+	if c.packets > 1 {
+		delta := math.Abs(float64(transit - c.transit))
+		c.jitter += (delta - c.jitter) / 16
+	}
+	c.transit = transit
+}
+
+func (c *counter) stats() streamStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := streamStats{
+		Bytes:      c.bytes,
+		Packets:    c.packets,
+		OutOfOrder: c.outOfOrder,
+		JitterMs:   c.jitter / float64(time.Millisecond),
+	}
+	if c.maxSeq > c.packets {
+		s.Lost = c.maxSeq - c.packets
+	}
+	return s
+}
+
+// pacer spreads rate bits per second, 0 is unlimited.
+type pacer struct {
+	rate  float64
+	start time.Time
+	sent  float64
+}
+
+func (p *pacer) wait(n int) {
+	if p.rate <= 0 {
+		return
+	}
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.sent += float64(n) * 8
+	if ahead := time.Duration(p.sent/p.rate*float64(time.Second)) - time.Since(p.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// sendTCP writes blocks of size n to conn until deadline.
+func sendTCP(ctx context.Context, conn net.Conn, deadline time.Time, rate float64, n int, c *counter) {
+	conn.SetWriteDeadline(deadline)
+	buf := make([]byte, n)
+	p := pacer{rate: rate}
+	for ctx.Err() == nil {
+		k, err := conn.Write(buf)
+		c.add(k)
+		if err != nil {
+			return
+		}
+		p.wait(k)
+	}
+}
+
+// receiveTCP reads conn until it is closed.
+func receiveTCP(r io.Reader, c *counter) {
+	buf := make([]byte, 64*1024)
+	for {
+		k, err := r.Read(buf)
+		c.add(k)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendUDP writes datagrams of size n until deadline, numbered from 1.
+func sendUDP(ctx context.Context, write func([]byte) (int, error), id uint64, stream int, deadline time.Time, rate float64, n int, c *counter) {
+	buf := make([]byte, n)
+	p := pacer{rate: rate}
+	for seq := uint64(1); ctx.Err() == nil && time.Now().Before(deadline); seq++ {
+		datagram{id: id, stream: uint32(stream), seq: seq, sent: time.Now().UnixNano()}.put(buf)
+		if k, err := write(buf); err == nil {
+			c.sent(k)
+		}
+		p.wait(n)
+	}
+}
@@ -0,0 +1,307 @@
+package throughput
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server answers tests on Port, tcp and udp, one test at a time. Secret,
+// when set, must be sent by clients. MaxTime, MaxStreams and MaxRate, in
+// bits per second, bound the tests, which run at MaxRate when they ask for
+// no rate. Streams must come from the address of
+// the control connection, so reverse tests only send to their client.
+type Server struct {
+	Port       int
+	Secret     string
+	MaxTime    int
+	MaxStreams int
+	MaxRate    uint64
+
+	mu   sync.Mutex
+	test *test
+	udp  *net.UDPConn
+}
+
+type test struct {
+	hello
+	id        uint64
+	peer      net.IP
+	streams   []*serverStream
+	connected int
+	ready     chan struct{}
+}
+
+type serverStream struct {
+	counter
+	conn net.Conn
+	addr *net.UDPAddr
+	// done is closed when a tcp receiver reached the end of its stream
+	done chan struct{}
+}
+
+// register counts a connected stream, s.mu must be held.
+func (t *test) register() {
+	if t.connected++; t.connected == len(t.streams) {
+		close(t.ready)
+	}
+}
+
+// Serve answers tests until ctx is done.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.Port == 0 {
+		s.Port = DefaultPort
+	}
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(s.Port))
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.Port})
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	s.udp = udp
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		udp.Close()
+	}()
+	go s.readUDP()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(connectWait))
+	var h hello
+	if err := readLine(br, &h); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if h.Stream == 0 {
+		s.control(ctx, conn, br, h)
+		return
+	}
+	s.mu.Lock()
+	t := s.test
+	if t == nil || t.Cookie != h.Cookie || t.Protocol != "tcp" || !t.peer.Equal(addrIP(conn.RemoteAddr())) || h.Stream < 1 || h.Stream > len(t.streams) || t.streams[h.Stream-1].conn != nil {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	st := t.streams[h.Stream-1]
+	st.conn = conn
+	t.register()
+	s.mu.Unlock()
+	if !t.Reverse {
+		receiveTCP(br, &st.counter)
+		close(st.done)
+	}
+}
+
+func (s *Server) readUDP() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		d, ok := parseDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		t := s.test
+		if t == nil || t.id != d.id || t.Protocol != "udp" || !t.peer.Equal(addr.IP) || d.stream < 1 || int(d.stream) > len(t.streams) {
+			s.mu.Unlock()
+			continue
+		}
+		st := t.streams[d.stream-1]
+		if d.seq == 0 {
+			if st.addr == nil {
+				st.addr = addr
+				t.register()
+			}
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		if !t.Reverse {
+			st.receive(n, d, now)
+		}
+	}
+}
+
+// addrIP returns the ip of a tcp or udp address.
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (s *Server) check(h hello) error {
+	if s.Secret != "" && subtle.ConstantTimeCompare([]byte(h.Secret), []byte(s.Secret)) != 1 {
+		return ErrSecret
+	}
+	if h.Protocol != "tcp" && h.Protocol != "udp" {
+		return fmt.Errorf("unknown protocol %q", h.Protocol)
+	}
+	if h.Streams < 1 || s.MaxStreams > 0 && h.Streams > s.MaxStreams {
+		return fmt.Errorf("streams must be between 1 and %d", s.MaxStreams)
+	}
+	if h.Time < 1 || s.MaxTime > 0 && h.Time > s.MaxTime {
+		return fmt.Errorf("time must be between 1 and %d", s.MaxTime)
+	}
+	if h.Protocol == "udp" && h.Rate == 0 {
+		return errors.New("udp tests need a rate")
+	}
+	if s.MaxRate > 0 && h.Rate > s.MaxRate {
+		return fmt.Errorf("rate must not exceed %d", s.MaxRate)
+	}
+	if h.Len < header || h.Len > maxLen || h.Protocol == "udp" && h.Len > 65507 {
+		return fmt.Errorf("invalid block size %d", h.Len)
+	}
+	return nil
+}
+
+// control runs a test for the client of conn.
+func (s *Server) control(ctx context.Context, conn net.Conn, br *bufio.Reader, h hello) {
+	defer conn.Close()
+	if err := s.check(h); err != nil {
+		writeLine(conn, reply{Err: err.Error()})
+		return
+	}
+	if h.Rate == 0 {
+		h.Rate = s.MaxRate
+	}
+	t := &test{
+		hello:   h,
+		id:      testID(h.Cookie),
+		peer:    addrIP(conn.RemoteAddr()),
+		streams: make([]*serverStream, h.Streams),
+		ready:   make(chan struct{}),
+	}
+	for i := range t.streams {
+		t.streams[i] = &serverStream{done: make(chan struct{})}
+	}
+	s.mu.Lock()
+	if s.test != nil {
+		s.mu.Unlock()
+		writeLine(conn, reply{Err: ErrBusy.Error()})
+		return
+	}
+	s.test = t
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.test = nil
+		s.mu.Unlock()
+		for _, st := range t.streams {
+			if st.conn != nil {
+				st.conn.Close()
+			}
+		}
+	}()
+	// the test ends early when the client goes away
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.Time)*time.Second+3*connectWait)
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		var d done
+		if readLine(br, &d) == nil {
+			close(finished)
+			readLine(br, &d)
+		}
+		cancel()
+	}()
+
+	if writeLine(conn, reply{Rate: h.Rate}) != nil {
+		return
+	}
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		return
+	case <-time.After(connectWait):
+		writeLine(conn, reply{Err: "streams did not connect"})
+		return
+	}
+	if writeLine(conn, reply{Start: true}) != nil {
+		return
+	}
+	start := time.Now()
+	if t.Reverse {
+		s.send(ctx, t, start.Add(time.Duration(h.Time)*time.Second))
+		for _, st := range t.streams {
+			if st.conn != nil {
+				st.conn.Close()
+			}
+		}
+	} else {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return
+		}
+		if h.Protocol == "tcp" {
+			wait := time.NewTimer(connectWait)
+			for _, st := range t.streams {
+				select {
+				case <-st.done:
+				case <-wait.C:
+				}
+			}
+			wait.Stop()
+		} else {
+			time.Sleep(udpGrace)
+		}
+	}
+	res := reply{Seconds: time.Since(start).Seconds()}
+	for _, st := range t.streams {
+		res.Streams = append(res.Streams, st.stats())
+	}
+	writeLine(conn, res)
+}
+
+// send sends every stream of a reverse test until deadline.
+func (s *Server) send(ctx context.Context, t *test, deadline time.Time) {
+	rate := float64(t.Rate) / float64(len(t.streams))
+	var wg sync.WaitGroup
+	for i, st := range t.streams {
+		wg.Add(1)
+		go func(i int, st *serverStream) {
+			defer wg.Done()
+			if t.Protocol == "tcp" {
+				sendTCP(ctx, st.conn, deadline, rate, t.Len, &st.counter)
+				return
+			}
+			write := func(b []byte) (int, error) {
+				return s.udp.WriteToUDP(b, st.addr)
+			}
+			sendUDP(ctx, write, t.id, i+1, deadline, rate, t.Len, &st.counter)
+		}(i, st)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package throughput
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs a server on a free loopback port until the test ends.
+func serve(t *testing.T) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	s := &Server{Port: port, Secret: "s", MaxTime: 5, MaxStreams: 4, MaxRate: 100 * 1000 * 1000}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Serve(ctx)
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return s
+}
+
+func TestLoopback(t *testing.T) {
+	s := serve(t)
+	for _, tc := range []struct {
+		name     string
+		protocol string
+		reverse  bool
+	}{
+		{"tcp", "tcp", false},
+		{"tcp reverse", "tcp", true},
+		{"udp", "udp", false},
+		{"udp reverse", "udp", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := Client(context.Background(), Options{
+				Host:     "127.0.0.1",
+				Port:     s.Port,
+				Protocol: tc.protocol,
+				Streams:  2,
+				Time:     1,
+				Reverse:  tc.reverse,
+				Rate:     10 * 1000 * 1000,
+				Secret:   "s",
+			}, nil)
+			if err != nil || !res.Success {
+				t.Fatalf("test failed: %v %s", err, res.Err)
+			}
+			if res.Sent == nil || res.Received == nil || res.Sent.Bytes == 0 || res.Received.Bytes == 0 {
+				t.Fatalf("no bytes counted: %+v %+v", res.Sent, res.Received)
+			}
+			if len(res.Start.Connected) != 2 {
+				t.Fatalf("%d streams connected, want 2", len(res.Start.Connected))
+			}
+		})
+	}
+}
+
+func TestRejected(t *testing.T) {
+	s := serve(t)
+	for _, tc := range []struct {
+		name string
+		opt  Options
+		err  string
+	}{
+		{"secret", Options{Secret: "x", Time: 1}, ErrSecret.Error()},
+		{"rate", Options{Secret: "s", Protocol: "udp", Rate: 200 * 1000 * 1000, Time: 1}, "rate must not exceed"},
+		{"time", Options{Secret: "s", Time: 10}, "time must be between"},
+		{"streams", Options{Secret: "s", Streams: 5, Time: 1}, "streams must be between"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opt.Host, tc.opt.Port = "127.0.0.1", s.Port
+			res, _ := Client(context.Background(), tc.opt, nil)
+			if res.Success || !strings.Contains(res.Err, tc.err) {
+				t.Fatalf("got %q, want %q", res.Err, tc.err)
+			}
+		})
+	}
+	if err := s.check(hello{Secret: "s", Protocol: "udp", Streams: 1, Time: 1, Len: DefaultUDPLen}); err == nil {
+		t.Fatal("udp test without a rate accepted")
+	}
+}
+
+// TestUnlimited checks that tests asking for no rate run at MaxRate.
+func TestUnlimited(t *testing.T) {
+	s := serve(t)
+	for _, reverse := range []bool{false, true} {
+		res, err := Client(context.Background(), Options{
+			Host:    "127.0.0.1",
+			Port:    s.Port,
+			Time:    1,
+			Reverse: reverse,
+			Secret:  "s",
+		}, nil)
+		if err != nil || !res.Success {
+			t.Fatalf("test failed: %v %s", err, res.Err)
+		}
+		// a second at MaxRate with some slack for the bursts
+		if max := 2 * s.MaxRate / 8; res.Received.Bytes > max {
+			t.Errorf("reverse %v: %d bytes received, want at most %d", reverse, res.Received.Bytes, max)
+		}
+	}
+}
+
+// TestForeignStream checks that streams from another address than the
+// control connection's are ignored.
+func TestForeignStream(t *testing.T) {
+	s := serve(t)
+	tt := &test{
+		hello:   hello{Protocol: "udp"},
+		id:      1,
+		peer:    net.ParseIP("127.0.0.1"),
+		streams: []*serverStream{{}},
+		ready:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.test = tt
+	s.mu.Unlock()
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: s.Port})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, header)
+	datagram{id: 1, stream: 1}.put(buf)
+	conn.Write(buf)
+	time.Sleep(100 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tt.streams[0].addr != nil {
+		t.Fatalf("stream registered from %v", tt.streams[0].addr)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheck is how often the certificate files are checked for changes.
+const reloadCheck = 10 * time.Second
+
+// certStore serves the certificate and client CA pool from disk and reloads
+// them when the files change, so renewed certificates are picked up without
+// a restart.
+type certStore struct {
+	conf TLS
+
+	mu      sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertStore(conf TLS) (*certStore, error) {
+	if conf.SelfSigned {
+		if err := bootstrapCert(conf.Cert, conf.Key); err != nil {
+			return nil, err
+		}
+	}
+	s := &certStore{conf: conf}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *certStore) files() []string {
+	files := []string{s.conf.Cert, s.conf.Key}
+	if s.conf.ClientCa != "" {
+		files = append(files, s.conf.ClientCa)
+	}
+	return files
+}
+
+// latest returns the newest modification time of the files.
+func (s *certStore) latest() (t time.Time, err error) {
+	for _, f := range s.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return
+}
+
+func (s *certStore) load() error {
+	mtime, err := s.latest()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.conf.Cert, s.conf.Key)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if s.conf.ClientCa != "" {
+		pem, err := ioutil.ReadFile(s.conf.ClientCa)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", s.conf.ClientCa)
+		}
+	}
+	s.cert, s.pool, s.mtime = &cert, pool, mtime
+	return nil
+}
+
+// current reloads the files if they changed since the last load. A broken
+// renewal keeps the previous certificate in use.
+func (s *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checked) >= reloadCheck {
+		s.checked = time.Now()
+		if mtime, err := s.latest(); err == nil && mtime.After(s.mtime) {
+			if err := s.load(); err != nil {
+				log.Println("tls: reload:", err)
+			} else {
+				log.Println("tls: certificate reloaded")
+			}
+		}
+	}
+	return s.cert, s.pool
+}
+
+func (s *certStore) config() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if s.conf.ClientCa != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if s.conf.RequireClientCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := s.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+}
+
+// bootstrapCert writes a self-signed certificate for the first deployment
+// unless the files already exist.
+func bootstrapCert(certFile, keyFile string) error {
+	_, errCert := os.Stat(certFile)
+	_, errKey := os.Stat(keyFile)
+	if errCert == nil && errKey == nil {
+		return nil
+	}
+	if !errors.Is(errCert, os.ErrNotExist) || !errors.Is(errKey, os.ErrNotExist) {
+		return fmt.Errorf("tls: only one of %s and %s exists", certFile, keyFile)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"neko-exporter"}},
+		DNSNames:              []string{hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Generated self-signed certificate %s, sha256 fingerprint: %X\n", certFile, sha256.Sum256(der))
+	return nil
+}